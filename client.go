@@ -2,10 +2,11 @@ package etpi
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net"
 	"strconv"
 	"sync"
@@ -14,27 +15,99 @@ import (
 
 type Client interface {
 	Connect(string, string, string) error
+	Attach(io.ReadWriteCloser, string, string) error
 	Disconnect()
 	Send(Command) error
+	SendWithCode(Command, string) error
 	Status() error
 	HandleZoneState(func(int, ZoneStatus))
+	HandleZoneEvent(func(int, int, ZoneEvent))
+	HandleBypassedZones(func([]int))
 	HandlePartitionState(func(int, PartitionStatus))
+	HandlePartitionEvent(func(int, PartitionEvent, int))
 	HandleKeypadState(func(KeypadStatus))
+	HandleTimeBroadcast(func(time.Time))
+	HandleTemperature(func(int, TemperatureKind, int))
+	HandleOutput(func(int, int, OutputEvent))
+	HandleChime(func(int, bool))
+	HandleError(func(error))
+	HandleCodeSent(func(CodeKind))
+	HandleLifeSafety(func(LifeSafetyEvent))
+	HandleCommunicator(func(CommunicatorEvent))
+	HandleTrouble(func(bool))
+	HandleDisconnect(func(error))
+	Metrics() Metrics
+	Health() Health
 }
 
 type client struct {
-	conn net.Conn
+	conn io.ReadWriteCloser
 	pwd  string
 	code string
 	sync.RWMutex
-	response        chan Command
+	sending         sync.Mutex
+	pmu             sync.Mutex
+	pending         chan Command
+	pendingCode     string
 	handleZone      func(int, ZoneStatus)
+	handleZoneEvent func(int, int, ZoneEvent)
+	handleBypass    func([]int)
 	handlePartition func(int, PartitionStatus)
+	handlePartEvent func(int, PartitionEvent, int)
 	handleKeypad    func(KeypadStatus)
+	handleTime      func(time.Time)
+	handleTemp      func(int, TemperatureKind, int)
+	handleOutput    func(int, int, OutputEvent)
+	handleChime     func(int, bool)
+	handleError     func(error)
+	handleCodeSent  func(CodeKind)
+	handleSafety    func(LifeSafetyEvent)
+	handleComm      func(CommunicatorEvent)
+	handleTrouble   func(bool)
+	leds            byte
+	flash           byte
+	handleDown      func(error)
+	metrics         *metrics
+	health          *health
+	log             Logger
+	redact          bool
+	open            func(string) (io.ReadWriteCloser, error)
+	ackTimeout      time.Duration
+	master          Secret
+	installer       Secret
+	keepAlive       time.Duration
+	maxMissed       int
+	closing         bool
+	reason          error
+	greeted         bool
+	requestCode     string
 }
 
-func NewClient() Client {
-	return &client{response: make(chan Command)}
+// NewClient creates a new Client configured by the supplied options.
+func NewClient(opts ...Option) Client {
+	cfg := newConfig(opts)
+	open := cfg.transport
+	if open == nil {
+		dialer := cfg.dialer
+		if dialer == nil {
+			dialer = &net.Dialer{Timeout: cfg.dialTimeout}
+		}
+		open = func(host string) (io.ReadWriteCloser, error) {
+			return dialer.Dial("tcp", host)
+		}
+	}
+	return &client{
+		metrics:    newMetrics(),
+		health:     &health{},
+		log:        cfg.logger,
+		redact:     cfg.redact,
+		open:       open,
+		ackTimeout: cfg.ackTimeout,
+		master:     cfg.master,
+		installer:  cfg.installer,
+		keepAlive:  cfg.keepAlive,
+		maxMissed:  cfg.maxMissed,
+	}
 }
 
 // Connect opens a connection to an Envisalink device.
@@ -58,21 +131,58 @@ func NewClient() Client {
 // password is accepted, the session is created and will continue until the TCP
 // connection is dropped.
 //
+// The connection is opened with the transport set by WithTransport, if any,
+// otherwise by dialing host over TCP.
 func (c *client) Connect(host string, pwd string, code string) error {
-	conn, err := net.DialTimeout("tcp", host, time.Second)
+	conn, err := c.open(host)
 	if err != nil {
 		return err
 	}
+	c.log.Info("connected to Envisalink", "host", host)
+	return c.Attach(conn, pwd, code)
+}
+
+// Attach starts a session over an already open connection to an Envisalink
+// device, such as a TLS tunnel, a serial adapter or an in-memory pipe. The
+// client takes ownership of conn and closes it on Disconnect, or when another
+// connection is attached.
+func (c *client) Attach(conn io.ReadWriteCloser, pwd string, code string) error {
+	if conn == nil {
+		return errors.New("nil connection")
+	}
+	c.Lock()
+	old := c.conn
 	c.conn = conn
+	c.closing = false
+	c.reason = nil
+	c.greeted = false
+	c.Unlock()
+	if old != nil && old != conn {
+		// The Envisalink accepts only one session, which the previous
+		// connection would keep busy.
+		old.Close()
+	}
 	c.pwd = pwd
 	c.code = code
-	go c.listen()
+	c.metrics.connected(true)
+	c.health.connected()
+	done := make(chan struct{})
+	go c.listen(conn, done)
+	if c.keepAlive > 0 {
+		go c.supervise(conn, done)
+	}
 	return nil
 }
 
+// Disconnect closes the connection. The handler set by HandleDisconnect is
+// not called for a session closed this way.
 func (c *client) Disconnect() {
-	if c.conn != nil {
-		c.conn.Close()
+	c.Lock()
+	conn := c.conn
+	c.closing = true
+	c.Unlock()
+	if conn != nil {
+		conn.Close()
 	}
 }
 
@@ -85,15 +195,77 @@ var ErrAPISystemNotReadytoArm = errors.New("system not ready, either not secure,
 var ErrAPICommandInvalidLength = errors.New("invalid length")
 var ErrAPIUserCodenotRequired = errors.New("user code not required")
 var ErrAPIInvalidCharacters = errors.New("invalid characters")
+var ErrInvalidAccessCode = errors.New("invalid access code")
+var ErrFunctionNotAvailable = errors.New("function not available")
+var ErrTimeout = errors.New("timeout awaiting response")
+var ErrNotConnected = errors.New("not connected to Envisalink")
+var ErrLinkDead = errors.New("no response from Envisalink, link declared dead")
+var ErrBadPassword = errors.New("login failed, password rejected by Envisalink")
+var ErrLoginTimeout = errors.New("login failed, password not sent in time")
+var ErrSessionInUse = errors.New("session refused by Envisalink, another client is connected")
 
+// Send writes a command to the Envisalink and waits for it to be
+// acknowledged. Only one command is outstanding at a time; concurrent calls
+// are sent in turn.
 func (c *client) Send(cmd Command) error {
-	log.Println("->", cmd)
+	c.sending.Lock()
+	defer c.sending.Unlock()
+	c.setRequestCode(cmd, "")
+	return c.send(cmd)
+}
+
+// SendWithCode sends cmd like Send, and answers a code request (900) that
+// follows it with code rather than the code the session was started with, so
+// that the panel attributes the action to that user. The code is used once,
+// and only for cmd: it is dropped if cmd fails or another command is sent
+// before the request.
+func (c *client) SendWithCode(cmd Command, code string) error {
+	c.sending.Lock()
+	defer c.sending.Unlock()
+	c.setRequestCode(cmd, code)
+	err := c.send(cmd)
+	if err != nil {
+		c.setRequestCode(cmd, "")
+	}
+	return err
+}
+
+// setRequestCode sets the code to answer a code request for cmd with, or
+// the session code if code is empty. The panel only requests a code for the
+// last command sent, so any command but a keep-alive poll replaces it.
+func (c *client) setRequestCode(cmd Command, code string) {
+	if cmd.Code == CommandPoll {
+		return
+	}
+	c.Lock()
+	c.requestCode = code
+	c.Unlock()
+}
+
+// send writes cmd and waits for its response. It must be called with
+// c.sending locked.
+func (c *client) send(cmd Command) error {
+	response := make(chan Command, 1)
+	c.pmu.Lock()
+	c.pending = response
+	c.pendingCode = cmd.Code
+	c.pmu.Unlock()
+	defer func() {
+		c.pmu.Lock()
+		c.pending = nil
+		c.pendingCode = ""
+		c.pmu.Unlock()
+	}()
+
+	c.logFrame("->", cmd)
 	err := c.write(cmd)
 	if err != nil {
 		return err
 	}
+	sent := c.health.sent()
 	select {
-	case resp := <-c.response:
+	case resp := <-response:
+		c.health.responded(sent)
 		switch resp.Code {
 		case CommandAck:
 			return nil
@@ -123,130 +295,389 @@ func (c *client) Send(cmd Command) error {
 				return fmt.Errorf("unknown system error %s", resp.Data)
 			}
 		}
-	case <-time.After(time.Second):
+	case <-time.After(c.ackTimeout):
 	}
 
-	return errors.New("timeout awaiting response")
+	c.health.failed()
+	return ErrTimeout
 }
 
 func (c *client) write(cmd Command) error {
 	c.Lock()
 	defer c.Unlock()
+	if c.conn == nil {
+		return ErrNotConnected
+	}
 	_, err := cmd.WriteTo(c.conn)
+	if err == nil {
+		c.metrics.sent()
+	}
 	return err
 }
 
-func (c *client) listen() {
-	r := bufio.NewReader(c.conn)
+func (c *client) listen(conn io.ReadWriteCloser, done chan struct{}) {
+	defer close(done)
+	r := bufio.NewReader(conn)
 	for {
 		line, err := r.ReadBytes('\n')
 		if err != nil {
+			// Only mark the session down if it has not already been
+			// replaced by a subsequent Connect.
+			c.RLock()
+			current := c.conn == conn
+			closing, reason, handleDown := c.closing, c.reason, c.handleDown
+			greeted := c.greeted
+			c.RUnlock()
+			if !current {
+				return
+			}
+			if reason == nil {
+				reason = err
+				// The Envisalink accepts only one session, and drops
+				// any other connection without asking for a password.
+				if err == io.EOF && !greeted {
+					reason = ErrSessionInUse
+				}
+			}
+			c.metrics.connected(false)
+			c.health.disconnected()
+			c.log.Info("disconnected from Envisalink", "err", reason)
+			if !closing && handleDown != nil {
+				handleDown(reason)
+			}
 			return
 		}
+		// Frames still buffered from a connection replaced by a
+		// subsequent Attach are not handled.
+		c.RLock()
+		current := c.conn == conn
+		c.RUnlock()
+		if !current {
+			return
+		}
+		c.health.received()
 		c.handle(line)
 	}
 }
 
+// supervise sends a keep-alive poll to the Envisalink every keep-alive
+// interval, and closes conn if too many polls in a row go unanswered.
+func (c *client) supervise(conn io.ReadWriteCloser, done chan struct{}) {
+	t := time.NewTicker(c.keepAlive)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+		if err := c.poll(); err != ErrTimeout {
+			continue
+		}
+		missed := c.health.snapshot().ConsecutiveFailures
+		if missed < c.maxMissed {
+			c.log.Warn("keep-alive poll unanswered", "missed", missed)
+			continue
+		}
+		c.Lock()
+		if c.conn == conn {
+			c.reason = ErrLinkDead
+		}
+		c.Unlock()
+		c.log.Error("keep-alive failed, closing connection", "missed", missed)
+		conn.Close()
+		return
+	}
+}
+
+var lifeSafetyEvents = map[string]LifeSafetyEvent{
+	CommandDuressAlarm:             LifeSafetyDuress,
+	CommandSmokeAuxAlarm:           LifeSafetySmokeAlarm,
+	CommandSmokeAuxAlarmRestore:    LifeSafetySmokeRestored,
+	CommandFireTroubleAlarm:        LifeSafetyFireTrouble,
+	CommandFireTroubleAlarmRestore: LifeSafetyFireTroubleRestored,
+}
+
 func (c *client) handle(p []byte) {
 	cmd, err := NewCommandFromBytes(p)
 	if err != nil {
+		c.protocolError(err)
+		return
+	}
+	c.logFrame("<-", *cmd)
+	c.metrics.received(*cmd)
+	if err := validate(*cmd); err != nil {
+		c.protocolError(&ProtocolError{Code: cmd.Code, Frame: string(bytes.TrimSpace(p)), Err: err})
 		return
 	}
-	log.Println("<-", *cmd)
+	// The data has been validated, so it can be decoded without checking
+	// lengths or conversion errors.
 	switch cmd.Code {
 	case CommandAck, CommandCommandError, CommandSystemError:
-		select {
-		case c.response <- *cmd:
-		default:
+		c.pmu.Lock()
+		// 500 and 501 name the command they answer, so a late answer to
+		// a command that timed out, e.g. a keep-alive poll, is not taken
+		// for the answer to the next one. 501 may be sent without it.
+		stale := cmd.Code != CommandSystemError && cmd.Data != c.pendingCode &&
+			(cmd.Code == CommandAck || cmd.Data != "")
+		if stale {
+			c.log.Debug("discarding unexpected response", "cmd", cmd.Code, "data", cmd.Data, "pending", c.pendingCode)
+		} else if c.pending != nil {
+			c.pending <- *cmd
+			c.pending = nil
 		}
+		c.pmu.Unlock()
 	case CommandLoginStatus:
+		c.Lock()
+		c.greeted = true
+		c.Unlock()
 		switch cmd.Data[0] {
 		// 0 = Password provided was incorrect
+		case '0':
+			c.log.Error("login failed", "err", ErrBadPassword)
+			c.abort(ErrBadPassword)
 		// 2 = Time out. You did not send a password within 10 seconds.
-		case '0', '2':
-			c.Disconnect()
+		case '2':
+			c.log.Error("login failed", "err", ErrLoginTimeout)
+			c.abort(ErrLoginTimeout)
 		// 1 = Password Correct, session established
 		case '1':
-			c.Status()
+			go func() {
+				if err := c.Status(); err != nil {
+					c.log.Error("could not request status report", "err", err)
+				}
+			}()
 		// 3 = Request for password, sent after socket setup
 		case '3':
-			c.login()
-		}
-	case CommandZoneAlarm:
-		zone, _ := strconv.Atoi(string(cmd.Data[1:4]))
-		c.handleZone(zone, ZoneStatusAlarm)
-	case CommandZoneTamper:
-		zone, _ := strconv.Atoi(string(cmd.Data[1:4]))
-		c.handleZone(zone, ZoneStatusTamper)
-	case CommandZoneFault:
-		zone, _ := strconv.Atoi(cmd.Data)
-		c.handleZone(zone, ZoneStatusFault)
-	case CommandZoneOpen:
-		zone, _ := strconv.Atoi(cmd.Data)
-		c.handleZone(zone, ZoneStatusOpen)
-	case CommandZoneRestored:
+			go c.login()
+		}
+	case CommandZoneAlarm, CommandZoneAlarmRestore, CommandZoneTamper, CommandZoneTamperRestore:
+		partition, _ := strconv.Atoi(cmd.Data[:1])
+		zone, _ := strconv.Atoi(cmd.Data[1:4])
+		c.zoneEvent(zone, partition, zoneEvents[cmd.Code])
+	case CommandZoneFault, CommandZoneFaultRestore, CommandZoneOpen, CommandZoneRestored:
 		zone, _ := strconv.Atoi(cmd.Data)
-		c.handleZone(zone, ZoneStatusRestored)
-	case CommandPartitionReady:
-		partition, _ := strconv.Atoi(cmd.Data)
-		c.handlePartition(partition, PartitionStatusReady)
-	case CommandPartitionNotReady:
-		partition, _ := strconv.Atoi(cmd.Data)
-		c.handlePartition(partition, PartitionStatusNotReady)
-	case CommandPartitionBusy:
+		c.zoneEvent(zone, 0, zoneEvents[cmd.Code])
+	case CommandBypassedZones:
+		bits, _ := hex.DecodeString(cmd.Data)
+		var zones []int
+		for i, b := range bits {
+			for j := uint(0); j < 8; j++ {
+				if b&(1<<j) != 0 {
+					zones = append(zones, i*8+int(j)+1)
+				}
+			}
+		}
+		if c.handleBypass != nil {
+			c.handleBypass(zones)
+		}
+	case CommandDuressAlarm, CommandSmokeAuxAlarm, CommandSmokeAuxAlarmRestore,
+		CommandFireTroubleAlarm, CommandFireTroubleAlarmRestore:
+		event := lifeSafetyEvents[cmd.Code]
+		c.log.Warn("life safety event", "event", event)
+		if c.handleSafety != nil {
+			c.handleSafety(event)
+		}
+	case CommandPartitionReady, CommandPartitionNotReady, CommandPartitionReadyForceArm,
+		CommandPartitionAlarm, CommandPartitionDisarmed, CommandPartitionExitDelay,
+		CommandPartitionEntryDelay, CommandKeypadLockout, CommandPartitionFailedToArm,
+		CommandFailureToArm, CommandPartitionBusy, CommandSystemArmingInProgress,
+		CommandPartitionSpecialClosing, CommandPartitionPartialClosing, CommandPartitionSpecialOpening:
 		partition, _ := strconv.Atoi(cmd.Data)
-		c.handlePartition(partition, PartitionStatusBusy)
-	case CommandPartitionArmed:
+		c.partitionEvent(partition, partitionEvents[cmd.Code], 0)
+	case CommandPartitionArmed, CommandPartitionUserClosing, CommandPartitionUserOpening:
+		// The partition is followed by the mode or the user number.
 		partition, _ := strconv.Atoi(cmd.Data[:1])
-		mode, _ := strconv.Atoi(cmd.Data[1:2])
-		switch mode {
-		case 0:
-			c.handlePartition(partition, PartitionStatusArmedAway)
-		case 1:
-			c.handlePartition(partition, PartitionStatusArmedStay)
-		case 2:
-			c.handlePartition(partition, PartitionStatusArmedZeroEntryAway)
-		case 3:
-			c.handlePartition(partition, PartitionStatusArmedZeroEntryStay)
-		}
-	case CommandPartitionDisarmed:
+		detail, _ := strconv.Atoi(cmd.Data[1:])
+		c.partitionEvent(partition, partitionEvents[cmd.Code], detail)
+	case CommandInstallerMode:
+		c.partitionEvent(0, PartitionInstallerMode, 0)
+	case CommandPartitionOutputInProgress:
 		partition, _ := strconv.Atoi(cmd.Data)
-		c.handlePartition(partition, PartitionStatusDisarmed)
-	case CommandPartitionAlarm:
-		partition, _ := strconv.Atoi(cmd.Data)
-		c.handlePartition(partition, PartitionStatusAlarm)
-	case CommandPartitionExitDelay:
-		partition, _ := strconv.Atoi(cmd.Data)
-		c.handlePartition(partition, PartitionStatusExitDelay)
-	case CommandPartitionEntryDelay:
+		if c.handleOutput != nil {
+			c.handleOutput(partition, 0, OutputInProgress)
+		}
+	case CommandPartitionChimeEnabled, CommandPartitionChimeDisabled:
 		partition, _ := strconv.Atoi(cmd.Data)
-		c.handlePartition(partition, PartitionStatusEntryDelay)
-	case CommandPartitionSpecialClosing:
-		// ignore
-	case CommandKeypadLed:
+		if c.handleChime != nil {
+			c.handleChime(partition, cmd.Code == CommandPartitionChimeEnabled)
+		}
+	case CommandKeypadLed, CommandKeypadLedFlash:
 		tmp, _ := hex.DecodeString(cmd.Data)
-		state := tmp[0]
-		status := KeypadStatus{
-			Backlight: (state&0x80)>>7 == 1,
-			Fire:      (state&0x40)>>6 == 1,
-			Program:   (state&0x20)>>5 == 1,
-			Trouble:   (state&0x10)>>4 == 1,
-			Bypass:    (state&0x08)>>3 == 1,
-			Memory:    (state&0x04)>>2 == 1,
-			Armed:     (state&0x02)>>1 == 1,
-			Ready:     (state & 0x01) == 1,
-		}
-		c.handleKeypad(status)
+		if cmd.Code == CommandKeypadLed {
+			c.leds = tmp[0]
+		} else {
+			c.flash = tmp[0]
+		}
+		if c.handleKeypad != nil {
+			c.handleKeypad(newKeypadStatus(c.leds, c.flash))
+		}
+	case CommandTimeBroadcast:
+		t, err := time.ParseInLocation("1504010206", cmd.Data, time.Local)
+		if err != nil {
+			c.protocolError(&ProtocolError{Code: cmd.Code, Frame: string(bytes.TrimSpace(p)), Err: err})
+			return
+		}
+		if c.handleTime != nil {
+			c.handleTime(t)
+		}
+	case CommandIndoorTemperature, CommandOutdoorTemperature:
+		thermostat, _ := strconv.Atoi(cmd.Data[:1])
+		kind := TemperatureIndoor
+		if cmd.Code == CommandOutdoorTemperature {
+			kind = TemperatureOutdoor
+		}
+		if c.handleTemp != nil {
+			c.handleTemp(thermostat, kind, decodeTemperature(cmd.Data[1:4]))
+		}
+	case CommandThermostatSetPoints:
+		thermostat, _ := strconv.Atoi(cmd.Data[:1])
+		if c.handleTemp != nil {
+			c.handleTemp(thermostat, TemperatureCoolSetPoint, decodeTemperature(cmd.Data[1:4]))
+			c.handleTemp(thermostat, TemperatureHeatSetPoint, decodeTemperature(cmd.Data[4:7]))
+		}
 	case CommandCodeRequired:
-		log.Println("code requested, sending response")
-		cmd := Command{Code: CommandCode, Data: c.code}
-		c.Send(cmd)
-	case CommandTroubleOff:
+		go c.sendCode(UserCode)
+	case CommandInvalidAccessCode, CommandFunctionNotAvailable:
+		err := ErrInvalidAccessCode
+		if cmd.Code == CommandFunctionNotAvailable {
+			err = ErrFunctionNotAvailable
+		}
+		c.log.Warn("partition error", "partition", cmd.Data, "err", err)
+		if c.handleError != nil {
+			c.handleError(err)
+		}
+	case CommandMasterCodeRequired:
+		go c.sendCode(MasterCode)
+	case CommandInstallerCodeRequired:
+		go c.sendCode(InstallerCode)
+	case CommandOutputPressed:
+		partition, _ := strconv.Atoi(cmd.Data[:1])
+		output, _ := strconv.Atoi(cmd.Data[1:2])
+		if c.handleOutput != nil {
+			c.handleOutput(partition, output, OutputPressed)
+		}
+	case CommandRingDetected, CommandFTCTrouble, CommandBufferNearFull:
+		event := CommunicatorRingDetected
+		switch cmd.Code {
+		case CommandFTCTrouble:
+			event = CommunicatorFTCTrouble
+			c.log.Warn("panel failed to communicate with monitoring station")
+		case CommandBufferNearFull:
+			event = CommunicatorBufferNearFull
+		}
+		if c.handleComm != nil {
+			c.handleComm(event)
+		}
+	case CommandTroubleOn, CommandTroubleOff:
+		if c.handleTrouble != nil {
+			c.handleTrouble(cmd.Code == CommandTroubleOn)
+		}
 	default:
-		log.Printf("error: APICommandNotSupported: %v\n", cmd)
+		c.log.Warn("command not supported", "cmd", cmd)
+	}
+}
+
+// abort closes the connection, passing reason to the disconnect handler.
+func (c *client) abort(reason error) {
+	c.Lock()
+	conn := c.conn
+	c.reason = reason
+	c.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// zoneEvent passes a zone event to the handlers, if any. The partition is 0
+// if not reported.
+func (c *client) zoneEvent(zone int, partition int, event ZoneEvent) {
+	if c.handleZoneEvent != nil {
+		c.handleZoneEvent(zone, partition, event)
+	}
+	if status := event.status(); status != UnknownStatus && c.handleZone != nil {
+		c.handleZone(zone, status)
 	}
 }
 
+// partitionEvent passes a partition event to the handlers, if any. The
+// partition is 0 if the event applies to all partitions.
+func (c *client) partitionEvent(partition int, event PartitionEvent, detail int) {
+	if c.handlePartEvent != nil {
+		c.handlePartEvent(partition, event, detail)
+	}
+	if status := event.status(detail); status != UnknownStatus && c.handlePartition != nil {
+		c.handlePartition(partition, status)
+	}
+}
+
+// protocolError logs a malformed frame and passes the error to the error
+// handler, if any.
+func (c *client) protocolError(err error) {
+	c.metrics.protocolError()
+	c.log.Warn("discarding malformed frame", "err", err)
+	if c.handleError != nil {
+		c.handleError(err)
+	}
+}
+
+// logFrame logs a frame sent or received at debug level, masking any
+// secrets if redaction is enabled.
+func (c *client) logFrame(dir string, cmd Command) {
+	if c.redact {
+		cmd = cmd.redacted()
+	}
+	c.log.Debug("frame", "dir", dir, "cmd", cmd)
+}
+
+// sendCode answers a request from the panel for a code. If the code cannot
+// be supplied a CodeRequiredError is passed to the error handler instead.
+func (c *client) sendCode(kind CodeKind) {
+	code, err := c.secret(kind)
+	if err == nil && code == "" {
+		err = ErrCodeNotConfigured
+	}
+	if err != nil {
+		err = &CodeRequiredError{Kind: kind, Err: err}
+		c.log.Error("could not send code", "err", err)
+		if c.handleError != nil {
+			c.handleError(err)
+		}
+		return
+	}
+	c.log.Info("code requested, sending response", "kind", kind)
+	if err := c.Send(Command{Code: CommandCode, Data: code}); err != nil {
+		c.log.Error("could not send code", "kind", kind, "err", err)
+		return
+	}
+	if c.handleCodeSent != nil {
+		c.handleCodeSent(kind)
+	}
+}
+
+func (c *client) secret(kind CodeKind) (string, error) {
+	var s Secret
+	switch kind {
+	case UserCode:
+		c.Lock()
+		defer c.Unlock()
+		code := c.requestCode
+		c.requestCode = ""
+		if code != "" {
+			return code, nil
+		}
+		return c.code, nil
+	case MasterCode:
+		s = c.master
+	case InstallerCode:
+		s = c.installer
+	}
+	if s == nil {
+		return "", ErrCodeNotConfigured
+	}
+	return s()
+}
+
 func (c *client) login() error {
 	cmd := Command{Code: CommandLogin, Data: c.pwd}
 	return c.Send(cmd)
@@ -262,14 +693,156 @@ func (c *client) poll() error {
 	return c.Send(cmd)
 }
 
+// HandleZoneState sets a callback for zone alarm (601), tamper (603), fault
+// (605), open (609) and restored (610) events. It is kept for compatibility;
+// HandleZoneEvent reports every zone event.
 func (c *client) HandleZoneState(f func(int, ZoneStatus)) {
 	c.handleZone = f
 }
 
+// HandleZoneEvent sets a callback for every zone event (601-610). The
+// callback is passed the zone, the partition (0 if not reported) and the
+// event.
+func (c *client) HandleZoneEvent(f func(int, int, ZoneEvent)) {
+	c.handleZoneEvent = f
+}
+
+// HandleBypassedZones sets a callback for the bypassed zones dump (616). The
+// callback is passed the zones that are bypassed.
+func (c *client) HandleBypassedZones(f func([]int)) {
+	c.handleBypass = f
+}
+
+// HandlePartitionState sets a callback for partition events that map to a
+// PartitionStatus. It is kept for compatibility; HandlePartitionEvent reports
+// every partition event.
 func (c *client) HandlePartitionState(f func(int, PartitionStatus)) {
 	c.handlePartition = f
 }
 
+// HandlePartitionEvent sets a callback for every partition event (65x, 67x,
+// 680, 70x and 75x). The callback is passed the partition (0 for installer's
+// mode, which applies to all partitions), the event, and the mode digit of
+// PartitionArmed or the user number of PartitionUserClosing and
+// PartitionUserOpening.
+func (c *client) HandlePartitionEvent(f func(int, PartitionEvent, int)) {
+	c.handlePartEvent = f
+}
+
 func (c *client) HandleKeypadState(f func(KeypadStatus)) {
 	c.handleKeypad = f
 }
+
+// HandleTimeBroadcast sets a callback for the panel date and time sent by
+// the 550 broadcast, once enabled with the 055 Time Broadcast Control
+// command.
+func (c *client) HandleTimeBroadcast(f func(time.Time)) {
+	c.handleTime = f
+}
+
+// HandleTemperature sets a callback for the temperatures and set points
+// reported by EMS-100 escort thermostats (561, 562 and 563), once enabled
+// with the 057 Temperature Broadcast Control command. The callback is passed
+// the thermostat number, which reading it is and the temperature in degrees.
+func (c *client) HandleTemperature(f func(int, TemperatureKind, int)) {
+	c.handleTemp = f
+}
+
+// HandleOutput sets a callback for command output (PGM) events. The callback
+// is passed the partition, the output number (0 if not reported) and the
+// event.
+func (c *client) HandleOutput(f func(int, int, OutputEvent)) {
+	c.handleOutput = f
+}
+
+// HandleChime sets a callback for when the door chime of a partition is
+// enabled (663) or disabled (664).
+func (c *client) HandleChime(f func(int, bool)) {
+	c.handleChime = f
+}
+
+// HandleError sets a callback for errors that occur outside of a call to
+// Send, such as a CodeRequiredError when the panel asks for a code that is
+// not configured.
+func (c *client) HandleError(f func(error)) {
+	c.handleError = f
+}
+
+// HandleCodeSent sets a callback for when a code requested by the panel has
+// been sent and acknowledged.
+func (c *client) HandleCodeSent(f func(CodeKind)) {
+	c.handleCodeSent = f
+}
+
+// HandleLifeSafety sets a callback for duress (620), 2-wire smoke/aux alarm
+// (631, 632) and fire trouble (842, 843) events.
+func (c *client) HandleLifeSafety(f func(LifeSafetyEvent)) {
+	c.handleSafety = f
+}
+
+// HandleCommunicator sets a callback for phone line ring detect (560) and
+// communicator trouble (814, 816) events.
+func (c *client) HandleCommunicator(f func(CommunicatorEvent)) {
+	c.handleComm = f
+}
+
+// HandleTrouble sets a callback for when the keypad Trouble LED turns on
+// (840) or off (841).
+func (c *client) HandleTrouble(f func(bool)) {
+	c.handleTrouble = f
+}
+
+// HandleDisconnect sets a callback for when the session ends other than by a
+// call to Disconnect, e.g. because the Envisalink closed the connection or
+// stopped answering keep-alive polls (ErrLinkDead). A failed login is
+// reported as ErrBadPassword, ErrLoginTimeout or ErrSessionInUse.
+func (c *client) HandleDisconnect(f func(error)) {
+	c.Lock()
+	c.handleDown = f
+	c.Unlock()
+}
+
+// Health returns a report on the liveness of the connection.
+func (c *client) Health() Health {
+	return c.health.snapshot()
+}
+
+// Metrics returns a snapshot of the connection counters.
+func (c *client) Metrics() Metrics {
+	return c.metrics.snapshot()
+}
+
+// decodeTemperature decodes a 3 digit temperature, where values above 127
+// are negative temperatures in two's complement.
+func decodeTemperature(s string) int {
+	v, _ := strconv.Atoi(s)
+	if v > 127 {
+		v -= 256
+	}
+	return v
+}
+
+// newKeypadStatus combines the keypad LED state (510) and flash state (511)
+// bitmasks into a KeypadStatus.
+func newKeypadStatus(leds byte, flash byte) KeypadStatus {
+	status := KeypadStatus{
+		Backlight: (leds&0x80)>>7 == 1,
+		Fire:      (leds&0x40)>>6 == 1,
+		Program:   (leds&0x20)>>5 == 1,
+		Trouble:   (leds&0x10)>>4 == 1,
+		Bypass:    (leds&0x08)>>3 == 1,
+		Memory:    (leds&0x04)>>2 == 1,
+		Armed:     (leds&0x02)>>1 == 1,
+		Ready:     (leds & 0x01) == 1,
+	}
+	for led := LEDReady; led <= LEDBacklight; led++ {
+		bit := byte(1) << uint(led)
+		switch {
+		case flash&bit != 0:
+			status.LED[led] = LEDFlashing
+		case leds&bit != 0:
+			status.LED[led] = LEDOn
+		}
+	}
+	return status
+}
@@ -82,9 +82,7 @@ func (c *MockConn) Close() error {
 func TestClientLogin(t *testing.T) {
 	conn := NewMockConn()
 	c := NewClient().(*client)
-	c.conn = conn.Client
-	c.pwd = "user"
-	go c.listen()
+	c.Attach(conn.Client, "user", "")
 	var w sync.WaitGroup
 	w.Add(1)
 	go func() {
@@ -94,7 +92,7 @@ func TestClientLogin(t *testing.T) {
 			t.Error(err, line)
 		}
 		time.Sleep(50 * time.Millisecond)
-		Command{Code: CommandAck}.WriteTo(conn.Server)
+		Command{Code: CommandAck, Data: CommandLogin}.WriteTo(conn.Server)
 		w.Done()
 	}()
 	err := c.login()
@@ -106,20 +104,15 @@ func TestClientLogin(t *testing.T) {
 
 func TestListen(t *testing.T) {
 	conn := NewMockConn()
-	c := NewClient().(*client)
-	c.conn = conn.Client
-	go c.listen()
+	c := NewClient()
+	c.Attach(conn.Client, "user", "")
 	c.Disconnect()
 }
 
 func TestClientLoginRequest(t *testing.T) {
 	conn := NewMockConn()
-	c := NewClient().(*client)
-	c.conn = conn.Client
-	c.pwd = "user"
-	var w sync.WaitGroup
-	w.Add(1)
-	go c.listen()
+	c := NewClient()
+	c.Attach(conn.Client, "user", "")
 	r := bufio.NewReader(conn.Server)
 	cmd := Command{Code: "505", Data: "3"}
 	cmd.WriteTo(conn.Server)
@@ -128,3 +121,275 @@ func TestClientLoginRequest(t *testing.T) {
 		t.Error(err, line)
 	}
 }
+
+func TestClientMetrics(t *testing.T) {
+	c := NewClient().(*client)
+	c.metrics.connected(true)
+	for _, cmd := range []Command{
+		{Code: CommandAck},
+		{Code: CommandCommandError},
+		{Code: CommandSystemError, Data: "024"},
+		{Code: CommandSystemError, Data: "024"},
+		{Code: CommandZoneOpen, Data: "001"},
+	} {
+		c.metrics.received(cmd)
+	}
+	c.metrics.connected(false)
+	c.metrics.connected(true)
+
+	m := c.Metrics()
+	if !m.Connected || m.Connects != 2 || m.Reconnects != 1 {
+		t.Errorf("unexpected connection metrics %+v", m)
+	}
+	if m.Acks != 1 || m.CommandErrors != 1 || m.SystemErrors["024"] != 2 {
+		t.Errorf("unexpected response metrics %+v", m)
+	}
+	if m.FramesReceived[CommandSystemError] != 2 || m.FramesReceived[CommandZoneOpen] != 1 {
+		t.Errorf("unexpected frame metrics %+v", m.FramesReceived)
+	}
+	m.SystemErrors["024"] = 0
+	if c.Metrics().SystemErrors["024"] != 2 {
+		t.Error("snapshot shares state with client")
+	}
+}
+
+type mockDialer struct {
+	conn *MockConn
+}
+
+func (d mockDialer) Dial(network, address string) (net.Conn, error) {
+	return d.conn.Client, nil
+}
+
+func TestClientOptions(t *testing.T) {
+	conn := NewMockConn()
+	c := NewClient(WithDialer(mockDialer{conn}), WithAckTimeout(10*time.Millisecond))
+	if err := c.Connect("envisalink:4025", "user", "1234"); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Disconnect()
+	go bufio.NewReader(conn.Server).ReadString('\n')
+	start := time.Now()
+	if err := c.Status(); err == nil {
+		t.Error("expected timeout awaiting response")
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("ack timeout not applied, waited %v", d)
+	}
+}
+
+func TestClientTransport(t *testing.T) {
+	conn := NewMockConn()
+	var addr string
+	c := NewClient(WithTransport(func(address string) (io.ReadWriteCloser, error) {
+		addr = address
+		return conn.Client, nil
+	}))
+	if err := c.Connect("/dev/ttyUSB0", "user", ""); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Disconnect()
+	if addr != "/dev/ttyUSB0" {
+		t.Errorf("expected transport to be opened with address, got %q", addr)
+	}
+	Command{Code: CommandLoginStatus, Data: "3"}.WriteTo(conn.Server)
+	line, err := bufio.NewReader(conn.Server).ReadString('\n')
+	if err != nil || line != "005user54\r\n" {
+		t.Error(err, line)
+	}
+}
+
+func TestClientKeepAlive(t *testing.T) {
+	conn := NewMockConn()
+	c := NewClient(
+		WithKeepAlive(10*time.Millisecond),
+		WithAckTimeout(10*time.Millisecond),
+		WithMaxMissed(2),
+	)
+	down := make(chan error, 1)
+	c.HandleDisconnect(func(err error) { down <- err })
+	c.Attach(conn.Client, "user", "")
+
+	// Acknowledge the first poll only, then stop answering.
+	go func() {
+		r := bufio.NewReader(conn.Server)
+		r.ReadString('\n')
+		Command{Code: CommandAck, Data: CommandPoll}.WriteTo(conn.Server)
+		for {
+			if _, err := r.ReadString('\n'); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case err := <-down:
+		if err != ErrLinkDead {
+			t.Errorf("expected ErrLinkDead, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("link not declared dead")
+	}
+	h := c.Health()
+	if h.Connected || h.LastReceived.IsZero() || h.LastSent.IsZero() || h.Latency == 0 {
+		t.Errorf("unexpected health report %+v", h)
+	}
+	if h.ConsecutiveFailures != 2 {
+		t.Errorf("expected 2 consecutive failures, got %d", h.ConsecutiveFailures)
+	}
+}
+
+func TestClientReattach(t *testing.T) {
+	first, second := NewMockConn(), NewMockConn()
+	c := NewClient(WithKeepAlive(0))
+	zones := make(chan int, 2)
+	c.HandleZoneState(func(zone int, status ZoneStatus) { zones <- zone })
+	c.Attach(first.Client, "user", "")
+	c.Attach(second.Client, "user", "")
+	defer c.Disconnect()
+
+	// The first connection is closed, so its frames no longer reach the
+	// handlers.
+	if _, err := (Command{Code: CommandZoneOpen, Data: "001"}).WriteTo(first.Server); err == nil {
+		t.Error("expected the replaced connection to be closed")
+	}
+	Command{Code: CommandZoneOpen, Data: "002"}.WriteTo(second.Server)
+	if zone := <-zones; zone != 2 {
+		t.Errorf("expected zone 2, got %d", zone)
+	}
+	select {
+	case zone := <-zones:
+		t.Errorf("unexpected event for zone %d", zone)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestClientStaleAck(t *testing.T) {
+	conn := NewMockConn()
+	c := NewClient(WithKeepAlive(0), WithAckTimeout(50*time.Millisecond))
+	c.Attach(conn.Client, "user", "")
+	defer c.Disconnect()
+
+	r := bufio.NewReader(conn.Server)
+	read := make(chan struct{})
+	go func() {
+		r.ReadString('\n')
+		close(read)
+	}()
+	if err := c.Send(Command{Code: CommandPoll}); err != ErrTimeout {
+		t.Fatalf("expected ErrTimeout, got %v", err)
+	}
+	<-read
+	// The late acknowledgement of the poll is not taken for that of the
+	// arm command.
+	go func() {
+		r.ReadString('\n')
+		Command{Code: CommandAck, Data: CommandPoll}.WriteTo(conn.Server)
+		Command{Code: CommandSystemError, Data: "024"}.WriteTo(conn.Server)
+	}()
+	err := c.Send(Command{Code: CommandPartitionArmControlAway, Data: "1"})
+	if err != ErrAPISystemNotReadytoArm {
+		t.Errorf("expected ErrAPISystemNotReadytoArm, got %v", err)
+	}
+}
+
+func TestClientCodeRequired(t *testing.T) {
+	conn := NewMockConn()
+	c := NewClient(WithMasterCode(StaticSecret("5555")))
+	errs := make(chan error, 1)
+	c.HandleError(func(err error) { errs <- err })
+	c.Attach(conn.Client, "user", "1234")
+	defer c.Disconnect()
+
+	r := bufio.NewReader(conn.Server)
+	Command{Code: CommandMasterCodeRequired}.WriteTo(conn.Server)
+	line, err := r.ReadString('\n')
+	if err != nil || line[:7] != "2005555" {
+		t.Error(err, line)
+	}
+	Command{Code: CommandAck, Data: CommandCode}.WriteTo(conn.Server)
+
+	Command{Code: CommandInstallerCodeRequired}.WriteTo(conn.Server)
+	select {
+	case err := <-errs:
+		e, ok := err.(*CodeRequiredError)
+		if !ok || e.Kind != InstallerCode || e.Err != ErrCodeNotConfigured {
+			t.Errorf("expected installer CodeRequiredError, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected error for missing installer code")
+	}
+}
+
+func TestClientKeypadFlash(t *testing.T) {
+	conn := NewMockConn()
+	c := NewClient()
+	events := make(chan KeypadStatus, 2)
+	c.HandleKeypadState(func(status KeypadStatus) { events <- status })
+	c.Attach(conn.Client, "user", "")
+	defer c.Disconnect()
+
+	Command{Code: CommandKeypadLed, Data: "91"}.WriteTo(conn.Server)
+	status := <-events
+	if !status.Trouble || status.State(LEDTrouble) != LEDOn || status.State(LEDArmed) != LEDOff {
+		t.Errorf("unexpected keypad status %+v", status)
+	}
+	Command{Code: CommandKeypadLedFlash, Data: "10"}.WriteTo(conn.Server)
+	status = <-events
+	if status.State(LEDTrouble) != LEDFlashing || status.State(LEDReady) != LEDOn || status.State(LEDBacklight) != LEDOn {
+		t.Errorf("expected flashing trouble light, got %+v", status.LED)
+	}
+}
+
+func TestClientProtocolError(t *testing.T) {
+	conn := NewMockConn()
+	c := NewClient(WithKeepAlive(0))
+	errs := make(chan error, 3)
+	c.HandleError(func(err error) { errs <- err })
+	zones := make(chan int, 1)
+	c.HandleZoneState(func(zone int, status ZoneStatus) { zones <- zone })
+	c.Attach(conn.Client, "user", "")
+	defer c.Disconnect()
+
+	// Neither the zone out of range, the short 652 nor the line noise may
+	// reach a handler, and none of them has a partition handler to call.
+	Command{Code: CommandZoneOpen, Data: "065"}.WriteTo(conn.Server)
+	Command{Code: CommandPartitionArmed, Data: "1"}.WriteTo(conn.Server)
+	conn.Server.Write([]byte("\x15\xff6\r\n"))
+	Command{Code: CommandZoneOpen, Data: "064"}.WriteTo(conn.Server)
+	for i := 0; i < 3; i++ {
+		err := <-errs
+		if _, ok := err.(*ProtocolError); !ok {
+			t.Errorf("expected ProtocolError, got %v", err)
+		}
+	}
+	if zone := <-zones; zone != 64 {
+		t.Errorf("expected zone 64, got %d", zone)
+	}
+	if m := c.Metrics(); m.ProtocolErrors != 3 {
+		t.Errorf("expected 3 protocol errors, got %d", m.ProtocolErrors)
+	}
+}
+
+func TestClientArmingInProgress(t *testing.T) {
+	conn := NewMockConn()
+	c := NewClient(WithKeepAlive(0))
+	events := make(chan PartitionEvent, 1)
+	c.HandlePartitionEvent(func(partition int, event PartitionEvent, detail int) {
+		if partition == 2 {
+			events <- event
+		}
+	})
+	c.Attach(conn.Client, "user", "")
+	defer c.Disconnect()
+
+	Command{Code: CommandSystemArmingInProgress, Data: "2"}.WriteTo(conn.Server)
+	select {
+	case event := <-events:
+		if event != PartitionArmingInProgress {
+			t.Errorf("expected ARMING_IN_PROGRESS, got %v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected partition event for 674")
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/service"
+)
+
+// newChime returns a HomeKit switch that enables and disables the door chime
+// of a partition.
+func newChime(partition int, on bool) *service.Switch {
+	s := service.NewSwitch()
+	name := characteristic.NewName()
+	name.SetValue(fmt.Sprintf("Chime %d", partition))
+	s.AddCharacteristic(name.Characteristic)
+	s.On.SetValue(on)
+	s.On.OnValueRemoteUpdate(func(on bool) {
+		log.Println("Setting chime of partition", partition, "to", on)
+		if err := panel.SetChime(partition, on); err != nil {
+			log.Println("error:", err)
+			s.On.SetValue(!on)
+		}
+	})
+	return s
+}
+
+func handleChime(partition int, on bool) {
+	if acc == nil || partition > len(acc.Chimes) {
+		return
+	}
+	acc.Chimes[partition-1].On.SetValue(on)
+}
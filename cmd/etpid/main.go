@@ -1,7 +1,10 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
@@ -16,20 +19,37 @@ import (
 )
 
 var panel etpi.Panel
+var controller etpi.Controller
 
 var pwd string
 var code string
 var etpiAddr string
 var pollDuration time.Duration
+var metricsAddr string
+var logLevel string
+var thermostats int
+var fahrenheit bool
+var chimes int
+var masterCodeFile string
+var installerCodeFile string
 
 type SecuritySystem struct {
 	*accessory.Accessory
-	Security *service.SecuritySystem
-	Zone1    *service.ContactSensor
+	Security    *service.SecuritySystem
+	Fault       *characteristic.StatusFault
+	Zone1       *service.ContactSensor
+	Zone1Tamper *characteristic.StatusTampered
+	Thermostats []*Thermostat
+	Outputs     []*Output
+	Chimes      []*service.Switch
 }
 
 var acc *SecuritySystem
 
+// connectRetry is how long to wait before logging in again when the
+// Envisalink is busy with another client.
+const connectRetry = 30 * time.Second
+
 func main() {
 	cli.HelpFlag = cli.BoolFlag{
 		Name:  "help",
@@ -57,6 +77,16 @@ func main() {
 					Value:       "12345",
 					Destination: &code,
 				},
+				cli.StringFlag{
+					Name:        "master-code-file",
+					Usage:       "File containing the master code, supplied when the panel requests it",
+					Destination: &masterCodeFile,
+				},
+				cli.StringFlag{
+					Name:        "installer-code-file",
+					Usage:       "File containing the installer's code, supplied when the panel requests it",
+					Destination: &installerCodeFile,
+				},
 				cli.StringFlag{
 					Name:        "host, h",
 					Usage:       "Envisalink 4 IP address",
@@ -65,10 +95,40 @@ func main() {
 				},
 				cli.DurationFlag{
 					Name:        "poll",
-					Usage:       "Polling status frequency",
-					Value:       10 * time.Minute,
+					Usage:       "Keep-alive poll frequency, the connection is dropped after 3 unanswered polls",
+					Value:       time.Minute,
 					Destination: &pollDuration,
 				},
+				cli.StringFlag{
+					Name:        "metrics",
+					Usage:       "Address to serve Prometheus metrics on at /metrics (e.g., :9090), disabled if empty",
+					Destination: &metricsAddr,
+				},
+				cli.StringFlag{
+					Name:        "log-level",
+					Usage:       "Minimum level of library messages to log (debug, info, warn, error)",
+					Value:       "info",
+					Destination: &logLevel,
+				},
+				cli.IntFlag{
+					Name:        "thermostats",
+					Usage:       "Number of EMS-100 thermostats to expose as HomeKit temperature sensors",
+					Destination: &thermostats,
+				},
+				cli.StringSliceFlag{
+					Name:  "output",
+					Usage: "Expose a command output of partition 1 as a HomeKit switch or garage door, e.g. 1=garage (may be repeated)",
+				},
+				cli.IntFlag{
+					Name:        "chime",
+					Usage:       "Number of partitions, starting at 1, to expose door chime switches for",
+					Destination: &chimes,
+				},
+				cli.BoolFlag{
+					Name:        "fahrenheit",
+					Usage:       "Thermostat temperatures are reported by the panel in Fahrenheit",
+					Destination: &fahrenheit,
+				},
 			},
 		},
 	}
@@ -80,24 +140,78 @@ func main() {
 func handleRun(c *cli.Context) error {
 
 	// Setup for SIGINT or SIGTERM.
-	sigch := make(chan os.Signal)
+	sigch := make(chan os.Signal, 1)
 	signal.Notify(sigch, syscall.SIGINT, syscall.SIGTERM)
 
 	// Redirect log to STDOUT
 	log.SetOutput(os.Stdout)
 
+	level, err := parseLevel(logLevel)
+	if err != nil {
+		return err
+	}
+	var outputs []*Output
+	for _, s := range c.StringSlice("output") {
+		o, err := parseOutput(s)
+		if err != nil {
+			return err
+		}
+		outputs = append(outputs, o)
+	}
+	logger := etpi.NewStdLogger(log.New(os.Stdout, "", log.LstdFlags), level)
+
 	// Connect to EnvisaLink panel
-	panel = etpi.NewPanel()
-	panel.OnPartitionEvent(handlePartition)
-	panel.OnZoneEvent(handleZone)
+	opts := []etpi.Option{
+		etpi.WithLogger(logger),
+		etpi.WithRedaction(true),
+		etpi.WithKeepAlive(pollDuration),
+	}
+	if masterCodeFile != "" {
+		opts = append(opts, etpi.WithMasterCode(etpi.FileSecret(masterCodeFile)))
+	}
+	if installerCodeFile != "" {
+		opts = append(opts, etpi.WithInstallerCode(etpi.FileSecret(installerCodeFile)))
+	}
+	panel = etpi.NewPanel(opts...)
+	panel.OnPartitionStateEvent(handlePartition)
+	panel.OnZoneStateEvent(handleZone)
+	panel.OnThermostatEvent(handleThermostat)
+	panel.OnOutputEvent(handleOutput)
+	panel.OnChimeEvent(handleChime)
+	panel.OnCommunicatorEvent(handleCommunicator)
+	panel.OnTroubleEvent(handleTrouble)
+	panel.OnError(func(err error) {
+		log.Println("error:", err)
+	})
+	controller = etpi.NewController(panel, opts...)
+	controller.OnError(handleControlError)
+	controller.OnDrift(handleDrift)
+	defer controller.Stop()
+	down := make(chan error, 1)
+	panel.OnDisconnect(func(err error) {
+		down <- err
+	})
 	log.Println("Connecting to Envisalink connection to security panel at", etpiAddr)
-	if err := panel.Connect(etpiAddr, pwd, code); err != nil {
-		log.Println("error: could not connect to Envisalink at", err)
-		os.Exit(1)
+	for {
+		err := panel.Connect(etpiAddr, pwd, code)
+		if err == nil {
+			break
+		}
+		switch {
+		case errors.Is(err, etpi.ErrBadPassword):
+			log.Println("error: Envisalink rejected the password, check --pwd")
+			os.Exit(1)
+		case errors.Is(err, etpi.ErrSessionInUse), errors.Is(err, etpi.ErrLoginTimeout), errors.Is(err, etpi.ErrTimeout):
+			log.Println("error: could not log in to Envisalink:", err)
+			log.Println("Retrying in", connectRetry)
+			time.Sleep(connectRetry)
+		default:
+			log.Println("error: could not connect to Envisalink at", etpiAddr, err)
+			os.Exit(1)
+		}
 	}
 	defer panel.Disconnect()
 	status := panel.Status()
-	handlePartition(1, status.Partition[0])
 
 	// Setup HomeKit Alarm accessory
 	acc = &SecuritySystem{
@@ -113,8 +227,33 @@ func handleRun(c *cli.Context) error {
 	acc.Security.SecuritySystemCurrentState.SetValue(characteristic.SecuritySystemCurrentStateDisarmed)
 	acc.Security.SecuritySystemTargetState.SetValue(characteristic.SecuritySystemTargetStateDisarm)
 	acc.Security.SecuritySystemTargetState.OnValueRemoteUpdate(updateTargetState)
+	acc.Fault = characteristic.NewStatusFault()
+	acc.Security.AddCharacteristic(acc.Fault.Characteristic)
+	if status.FTCTrouble {
+		acc.Fault.SetValue(characteristic.StatusFaultGeneralFault)
+	}
 	acc.AddService(acc.Security.Service)
+	handlePartition(1, status.Partitions[0])
+	acc.Zone1Tamper = characteristic.NewStatusTampered()
+	acc.Zone1.AddCharacteristic(acc.Zone1Tamper.Characteristic)
 	acc.AddService(acc.Zone1.Service)
+	handleZone(1, status.Zones[0])
+	for i := 1; i <= thermostats && i <= len(status.Thermostat); i++ {
+		t := newThermostat(i)
+		acc.Thermostats = append(acc.Thermostats, t)
+		acc.AddService(t.Indoor.Service)
+		acc.AddService(t.Outdoor.Service)
+		handleThermostat(i, status.Thermostat[i-1])
+	}
+	for i := 1; i <= chimes && i <= len(status.Chime); i++ {
+		s := newChime(i, status.Chime[i-1])
+		acc.Chimes = append(acc.Chimes, s)
+		acc.AddService(s.Service)
+	}
+	for _, o := range outputs {
+		acc.Outputs = append(acc.Outputs, o)
+		acc.AddService(o.Service())
+	}
 
 	// Setup HomeKit IP Transport
 	config := hc.Config{
@@ -131,83 +270,140 @@ func handleRun(c *cli.Context) error {
 
 	go t.Start()
 
+	if metricsAddr != "" {
+		http.HandleFunc("/metrics", handleMetrics)
+		go func() {
+			log.Println("Serving metrics at", metricsAddr)
+			if err := http.ListenAndServe(metricsAddr, nil); err != nil {
+				log.Println("error: metrics server:", err)
+			}
+		}()
+	}
+
 	log.Println("Envisalink connection to security panel online")
-	log.Println("Polling for panel status every", pollDuration)
+	log.Println("Checking connection every", pollDuration)
 	log.Println("Hit Ctrl+C to terminate")
-	timer := time.NewTimer(pollDuration)
-	for {
-		select {
-		case <-sigch:
-			return nil
-		case <-timer.C:
-			log.Println("Polling panel status...")
-			if err := panel.Poll(); err != nil {
-				log.Println("error:", err)
-				os.Exit(1)
-			}
-			timer.Reset(pollDuration)
+	select {
+	case <-sigch:
+		return nil
+	case err := <-down:
+		log.Println("error: lost connection to Envisalink:", err)
+		os.Exit(1)
+	}
+	return nil
+}
+
+func handleCommunicator(event etpi.CommunicatorEvent) {
+	switch event {
+	case etpi.CommunicatorRingDetected:
+		log.Println("Phone line ring detected")
+	case etpi.CommunicatorBufferNearFull:
+		log.Println("warning: panel event buffer near full")
+	case etpi.CommunicatorFTCTrouble:
+		log.Println("warning: panel failed to communicate with monitoring station")
+		if acc != nil {
+			acc.Fault.SetValue(characteristic.StatusFaultGeneralFault)
 		}
 	}
 }
 
-func handlePartition(partition int, status etpi.PartitionStatus) {
+func handleTrouble(on bool) {
+	if acc == nil || on {
+		return
+	}
+	acc.Fault.SetValue(characteristic.StatusFaultNoFault)
+}
+
+func parseLevel(s string) (etpi.Level, error) {
+	switch s {
+	case "debug":
+		return etpi.LevelDebug, nil
+	case "info":
+		return etpi.LevelInfo, nil
+	case "warn":
+		return etpi.LevelWarn, nil
+	case "error":
+		return etpi.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+func handlePartition(partition int, state etpi.PartitionState) {
 	if acc == nil {
 		return
 	}
 	if partition != 1 {
 		return
 	}
-	switch status {
-	case etpi.PartitionStatusExitDelay:
-		acc.Security.SecuritySystemCurrentState.SetValue(characteristic.SecuritySystemCurrentStateDisarmed)
-		acc.Security.SecuritySystemTargetState.SetValue(characteristic.SecuritySystemTargetStateAwayArm)
-	case etpi.PartitionStatusReady,
-		etpi.PartitionStatusDisarmed:
-		acc.Security.SecuritySystemCurrentState.SetValue(characteristic.SecuritySystemCurrentStateDisarmed)
-		acc.Security.SecuritySystemTargetState.SetValue(characteristic.SecuritySystemTargetStateDisarm)
-	case etpi.PartitionStatusArmedAway,
-		etpi.PartitionStatusArmedZeroEntryAway:
+	switch {
+	case state.InAlarm:
+		acc.Security.SecuritySystemCurrentState.SetValue(characteristic.SecuritySystemCurrentStateAlarmTriggered)
+	case state.ArmMode == etpi.ArmAway,
+		state.ArmMode == etpi.ArmMax,
+		state.ArmMode == etpi.ArmForce:
 		acc.Security.SecuritySystemCurrentState.SetValue(characteristic.SecuritySystemCurrentStateAwayArm)
 		acc.Security.SecuritySystemTargetState.SetValue(characteristic.SecuritySystemTargetStateAwayArm)
-	case etpi.PartitionStatusArmedStay,
-		etpi.PartitionStatusArmedZeroEntryStay:
+	case state.ArmMode == etpi.ArmStay,
+		state.ArmMode == etpi.ArmInstant:
 		acc.Security.SecuritySystemCurrentState.SetValue(characteristic.SecuritySystemCurrentStateStayArm)
 		acc.Security.SecuritySystemTargetState.SetValue(characteristic.SecuritySystemTargetStateStayArm)
-	case etpi.PartitionStatusAlarm:
-		acc.Security.SecuritySystemCurrentState.SetValue(characteristic.SecuritySystemCurrentStateAlarmTriggered)
+	case state.ArmMode == etpi.ArmNight:
+		acc.Security.SecuritySystemCurrentState.SetValue(characteristic.SecuritySystemCurrentStateNightArm)
+		acc.Security.SecuritySystemTargetState.SetValue(characteristic.SecuritySystemTargetStateNightArm)
+	case state.ExitDelay:
+		acc.Security.SecuritySystemCurrentState.SetValue(characteristic.SecuritySystemCurrentStateDisarmed)
+		acc.Security.SecuritySystemTargetState.SetValue(characteristic.SecuritySystemTargetStateAwayArm)
+	default:
+		acc.Security.SecuritySystemCurrentState.SetValue(characteristic.SecuritySystemCurrentStateDisarmed)
+		acc.Security.SecuritySystemTargetState.SetValue(characteristic.SecuritySystemTargetStateDisarm)
 	}
 }
 
-func handleZone(zone int, status etpi.ZoneStatus) {
+func handleZone(zone int, state etpi.ZoneState) {
 	if acc == nil {
 		return
 	}
 	if zone != 1 {
 		return
 	}
-	switch status {
-	case etpi.ZoneStatusOpen:
+	if state.Open {
 		acc.Zone1.ContactSensorState.SetValue(characteristic.ContactSensorStateContactNotDetected)
-	case etpi.ZoneStatusRestored:
+	} else {
 		acc.Zone1.ContactSensorState.SetValue(characteristic.ContactSensorStateContactDetected)
 	}
+	if state.Tampered {
+		acc.Zone1Tamper.SetValue(characteristic.StatusTamperedTampered)
+	} else {
+		acc.Zone1Tamper.SetValue(characteristic.StatusTamperedNotTampered)
+	}
 }
 
 func updateTargetState(state int) {
 	log.Println("SecuritySystemTargetState.OnValueRemoteUpdate:", state)
+	var mode etpi.ArmMode
 	switch state {
-	case characteristic.SecuritySystemTargetStateStayArm,
-		characteristic.SecuritySystemTargetStateNightArm:
-		if err := panel.Arm(1, etpi.ArmStay); err != nil {
-			log.Println("error:", err)
-		}
+	case characteristic.SecuritySystemTargetStateStayArm:
+		mode = etpi.ArmStay
+	case characteristic.SecuritySystemTargetStateNightArm:
+		mode = etpi.ArmNight
 	case characteristic.SecuritySystemTargetStateAwayArm:
-		if err := panel.Arm(1, etpi.ArmAway); err != nil {
-			log.Println("error:", err)
-		}
-	case characteristic.SecuritySystemTargetStateDisarm:
-		if err := panel.Disarm(1); err != nil {
-			log.Println("error:", err)
-		}
+		mode = etpi.ArmAway
+	}
+	if err := controller.Set(1, mode); err != nil {
+		log.Println("error:", err)
+	}
+}
+
+// handleControlError shows why a partition could not be armed or disarmed,
+// and restores the HomeKit target state to the partition's actual state.
+func handleControlError(err error) {
+	log.Println("error:", err)
+	var cerr *etpi.ControlError
+	if errors.As(err, &cerr) {
+		handlePartition(cerr.Partition, panel.Status().Partitions[cerr.Partition-1])
 	}
 }
+
+func handleDrift(partition int, desired etpi.ArmMode, actual etpi.ArmMode) {
+	log.Println("Partition", partition, "changed at the keypad from", desired, "to", actual)
+}
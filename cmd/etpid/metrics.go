@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/lazyeights/etpi"
+)
+
+// handleMetrics serves the panel state and connection counters in the
+// Prometheus text exposition format.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w, panel.Status(), panel.Metrics())
+}
+
+func writeMetrics(w io.Writer, status *etpi.PanelStatus, m etpi.Metrics) {
+	metric(w, "etpi_up", "gauge", "Whether the Envisalink TPI session is connected.")
+	fmt.Fprintf(w, "etpi_up %d\n", b2i(m.Connected))
+
+	metric(w, "etpi_partition_status", "gauge", "Partition status (0=UNKNOWN 1=DISARMED_READY 2=DISARMED_NOT_READY 3=ARMED_AWAY 4=ARMED_STAY 5=ARMED_ZERO_ENTRY_AWAY 6=ARMED_ZERO_ENTRY_STAY 7=ALARM 8=DISARMED 9=EXIT_DELAY 10=ENTRY_DELAY 11=FAILED_TO_ARM 12=BUSY).")
+	for i, s := range status.Partition {
+		fmt.Fprintf(w, "etpi_partition_status{partition=\"%d\"} %d\n", i+1, s)
+	}
+
+	metric(w, "etpi_zone_status", "gauge", "Zone status (0=UNKNOWN 1=ALARM 2=TAMPER 3=FAULT 4=OPEN 5=RESTORED).")
+	for i, s := range status.Zone {
+		fmt.Fprintf(w, "etpi_zone_status{zone=\"%d\"} %d\n", i+1, s)
+	}
+
+	metric(w, "etpi_keypad_led", "gauge", "Keypad LED state (0=off 1=on 2=flashing).")
+	for led, state := range status.Keypad.LED {
+		fmt.Fprintf(w, "etpi_keypad_led{led=\"%s\"} %d\n", strings.ToLower(etpi.KeypadLED(led).String()), state)
+	}
+
+	metric(w, "etpi_commands_sent_total", "counter", "Commands sent to the Envisalink.")
+	fmt.Fprintf(w, "etpi_commands_sent_total %d\n", m.CommandsSent)
+
+	metric(w, "etpi_acks_total", "counter", "Command acknowledgements (500) received.")
+	fmt.Fprintf(w, "etpi_acks_total %d\n", m.Acks)
+
+	metric(w, "etpi_command_errors_total", "counter", "Command errors (501, bad checksum) received.")
+	fmt.Fprintf(w, "etpi_command_errors_total %d\n", m.CommandErrors)
+
+	metric(w, "etpi_system_errors_total", "counter", "System errors (502) received by error code.")
+	for _, code := range sortedKeys(m.SystemErrors) {
+		fmt.Fprintf(w, "etpi_system_errors_total{code=%q} %d\n", code, m.SystemErrors[code])
+	}
+
+	metric(w, "etpi_protocol_errors_total", "counter", "Malformed frames received and discarded.")
+	fmt.Fprintf(w, "etpi_protocol_errors_total %d\n", m.ProtocolErrors)
+
+	metric(w, "etpi_reconnects_total", "counter", "Reconnections to the Envisalink.")
+	fmt.Fprintf(w, "etpi_reconnects_total %d\n", m.Reconnects)
+
+	metric(w, "etpi_frames_received_total", "counter", "Frames received from the Envisalink by command code.")
+	for _, code := range sortedKeys(m.FramesReceived) {
+		fmt.Fprintf(w, "etpi_frames_received_total{code=%q} %d\n", code, m.FramesReceived[code])
+	}
+}
+
+func metric(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func b2i(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/service"
+	"github.com/lazyeights/etpi"
+)
+
+// Output exposes a command output (PGM) of partition 1 as a momentary HomeKit
+// switch or as a garage door opener.
+type Output struct {
+	Number int
+	Switch *service.Switch
+	Garage *service.GarageDoorOpener
+}
+
+// parseOutput parses an --output flag of the form "<output>=<switch|garage>",
+// e.g. "1=garage".
+func parseOutput(s string) (*Output, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid output %q, expected <output>=<switch|garage>", s)
+	}
+	n, err := strconv.Atoi(parts[0])
+	if err != nil || n < 1 || n > 4 {
+		return nil, fmt.Errorf("invalid output number %q, must be 1-4", parts[0])
+	}
+	o := &Output{Number: n}
+	name := characteristic.NewName()
+	name.SetValue(fmt.Sprintf("Output %d", n))
+	switch parts[1] {
+	case "switch":
+		o.Switch = service.NewSwitch()
+		o.Switch.AddCharacteristic(name.Characteristic)
+		o.Switch.On.OnValueRemoteUpdate(o.updateSwitch)
+	case "garage":
+		o.Garage = service.NewGarageDoorOpener()
+		o.Garage.AddCharacteristic(name.Characteristic)
+		o.Garage.CurrentDoorState.SetValue(characteristic.CurrentDoorStateClosed)
+		o.Garage.TargetDoorState.SetValue(characteristic.TargetDoorStateClosed)
+		o.Garage.TargetDoorState.OnValueRemoteUpdate(o.updateGarage)
+	default:
+		return nil, fmt.Errorf("invalid output type %q, expected switch or garage", parts[1])
+	}
+	return o, nil
+}
+
+func (o *Output) Service() *service.Service {
+	if o.Garage != nil {
+		return o.Garage.Service
+	}
+	return o.Switch.Service
+}
+
+func (o *Output) activate() error {
+	log.Println("Activating command output", o.Number)
+	if err := panel.ActivateOutput(1, o.Number); err != nil {
+		log.Println("error:", err)
+		return err
+	}
+	return nil
+}
+
+// updateSwitch activates the output when the switch is turned on, then turns
+// the switch back off as the output is momentary.
+func (o *Output) updateSwitch(on bool) {
+	if !on {
+		return
+	}
+	o.activate()
+	time.AfterFunc(time.Second, func() {
+		o.Switch.On.SetValue(false)
+	})
+}
+
+// updateGarage activates the output to open or close the door. There is no
+// door sensor, so the door is assumed to reach the requested state.
+func (o *Output) updateGarage(state int) {
+	if err := o.activate(); err != nil {
+		o.Garage.TargetDoorState.SetValue(o.Garage.CurrentDoorState.GetValue())
+		return
+	}
+	o.Garage.CurrentDoorState.SetValue(state)
+}
+
+func handleOutput(partition int, output int, event etpi.OutputEvent) {
+	if partition != 1 {
+		return
+	}
+	log.Println("Command output", output, event)
+}
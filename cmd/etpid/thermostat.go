@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/service"
+	"github.com/lazyeights/etpi"
+)
+
+// Thermostat exposes the indoor and outdoor temperatures reported by an
+// EMS-100 escort thermostat as HomeKit temperature sensors.
+type Thermostat struct {
+	Indoor  *service.TemperatureSensor
+	Outdoor *service.TemperatureSensor
+}
+
+func newThermostat(n int) *Thermostat {
+	return &Thermostat{
+		Indoor:  newTemperatureSensor(fmt.Sprintf("Thermostat %d Indoor", n)),
+		Outdoor: newTemperatureSensor(fmt.Sprintf("Thermostat %d Outdoor", n)),
+	}
+}
+
+func newTemperatureSensor(name string) *service.TemperatureSensor {
+	s := service.NewTemperatureSensor()
+	s.CurrentTemperature.SetMinValue(-50)
+	n := characteristic.NewName()
+	n.SetValue(name)
+	s.AddCharacteristic(n.Characteristic)
+	return s
+}
+
+func handleThermostat(thermostat int, status etpi.ThermostatStatus) {
+	if acc == nil || thermostat > len(acc.Thermostats) || status.Updated.IsZero() {
+		return
+	}
+	t := acc.Thermostats[thermostat-1]
+	t.Indoor.CurrentTemperature.SetValue(celsius(status.Indoor))
+	t.Outdoor.CurrentTemperature.SetValue(celsius(status.Outdoor))
+}
+
+// celsius converts a temperature reported by the panel to degrees Celsius
+// as required by HomeKit.
+func celsius(degrees int) float64 {
+	if !fahrenheit {
+		return float64(degrees)
+	}
+	return float64(degrees-32) * 5 / 9
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strings"
 )
 
 const (
@@ -12,33 +13,75 @@ const (
 	CommandStatusReport                 = "001"
 	CommandLogin                        = "005"
 	CommandSetTimeAndDate               = "010"
+	CommandOutputControl                = "020"
 	CommandPartitionArmControlAway      = "030"
 	CommandPartitionArmControlStay      = "031"
 	CommandPartitionArmControlZeroEntry = "032"
+	CommandPartitionArmControlWithCode  = "033"
 	CommandPartitionDisarmControl       = "040"
+	CommandTimeBroadcastControl         = "055"
+	CommandTimeStampControl             = "056"
+	CommandTemperatureBroadcastControl  = "057"
+	CommandKeystroke                    = "071"
+	CommandUserCodeProgramming          = "072"
 	CommandCode                         = "200"
 	CommandAck                          = "500"
 	CommandCommandError                 = "501"
 	CommandSystemError                  = "502"
 	CommandLoginStatus                  = "505"
 	CommandKeypadLed                    = "510"
+	CommandKeypadLedFlash               = "511"
+	CommandTimeBroadcast                = "550"
+	CommandRingDetected                 = "560"
+	CommandIndoorTemperature            = "561"
+	CommandOutdoorTemperature           = "562"
+	CommandThermostatSetPoints          = "563"
 	CommandZoneAlarm                    = "601"
+	CommandZoneAlarmRestore             = "602"
 	CommandZoneTamper                   = "603"
+	CommandZoneTamperRestore            = "604"
 	CommandZoneFault                    = "605"
+	CommandZoneFaultRestore             = "606"
 	CommandZoneOpen                     = "609"
 	CommandZoneRestored                 = "610"
+	CommandBypassedZones                = "616"
+	CommandDuressAlarm                  = "620"
+	CommandSmokeAuxAlarm                = "631"
+	CommandSmokeAuxAlarmRestore         = "632"
 	CommandPartitionReady               = "650"
 	CommandPartitionNotReady            = "651"
 	CommandPartitionArmed               = "652"
+	CommandPartitionReadyForceArm       = "653"
 	CommandPartitionDisarmed            = "655"
 	CommandPartitionAlarm               = "654"
 	CommandPartitionExitDelay           = "656"
 	CommandPartitionEntryDelay          = "657"
+	CommandKeypadLockout                = "658"
+	CommandPartitionFailedToArm         = "659"
+	CommandPartitionOutputInProgress    = "660"
+	CommandPartitionChimeEnabled        = "663"
+	CommandPartitionChimeDisabled       = "664"
+	CommandInvalidAccessCode            = "670"
+	CommandFunctionNotAvailable         = "671"
+	CommandFailureToArm                 = "672"
 	CommandPartitionBusy                = "673"
+	CommandSystemArmingInProgress       = "674"
+	CommandInstallerMode                = "680"
+	CommandPartitionUserClosing         = "700"
 	CommandPartitionSpecialClosing      = "701"
+	CommandPartitionPartialClosing      = "702"
+	CommandPartitionUserOpening         = "750"
+	CommandPartitionSpecialOpening      = "751"
+	CommandFTCTrouble                   = "814"
+	CommandBufferNearFull               = "816"
 	CommandTroubleOn                    = "840"
 	CommandTroubleOff                   = "841"
+	CommandFireTroubleAlarm             = "842"
+	CommandFireTroubleAlarmRestore      = "843"
 	CommandCodeRequired                 = "900"
+	CommandOutputPressed                = "912"
+	CommandMasterCodeRequired           = "921"
+	CommandInstallerCodeRequired        = "922"
 )
 
 type Command struct {
@@ -57,14 +100,28 @@ func (c Command) String() string {
 		str = "Login"
 	case "010":
 		str = "SetTimeAndDate"
+	case "020":
+		str = "OutputControl"
 	case "030":
 		str = "PartitionArmControlAway"
 	case "031":
 		str = "PartitionArmControlStay"
 	case "032":
 		str = "PartitionArmControlZeroEntry"
+	case "033":
+		str = "PartitionArmControlWithCode"
 	case "040":
 		str = "PartitionDisarmControl"
+	case "055":
+		str = "TimeBroadcastControl"
+	case "056":
+		str = "TimeStampControl"
+	case "057":
+		str = "TemperatureBroadcastControl"
+	case "071":
+		str = "Keystroke"
+	case "072":
+		str = "UserCodeProgramming"
 	case "200":
 		str = "Code"
 	case "500":
@@ -77,22 +134,50 @@ func (c Command) String() string {
 		str = "LoginStatus"
 	case "510":
 		str = "KeypadLed"
+	case "511":
+		str = "KeypadLedFlash"
+	case "550":
+		str = "TimeBroadcast"
+	case "560":
+		str = "RingDetected"
+	case "561":
+		str = "IndoorTemperature"
+	case "562":
+		str = "OutdoorTemperature"
+	case "563":
+		str = "ThermostatSetPoints"
 	case "601":
 		str = "ZoneAlarm"
+	case "602":
+		str = "ZoneAlarmRestore"
 	case "603":
 		str = "ZoneTamper"
+	case "604":
+		str = "ZoneTamperRestore"
 	case "605":
 		str = "ZoneFault"
+	case "606":
+		str = "ZoneFaultRestore"
 	case "609":
 		str = "ZoneOpen"
 	case "610":
 		str = "ZoneRestored"
+	case "616":
+		str = "BypassedZones"
+	case "620":
+		str = "DuressAlarm"
+	case "631":
+		str = "SmokeAuxAlarm"
+	case "632":
+		str = "SmokeAuxAlarmRestore"
 	case "650":
 		str = "PartitionReady"
 	case "651":
 		str = "PartitionNotReady"
 	case "652":
 		str = "PartitionArmed"
+	case "653":
+		str = "PartitionReadyForceArm"
 	case "655":
 		str = "PartitionDisarmed"
 	case "654":
@@ -101,35 +186,108 @@ func (c Command) String() string {
 		str = "PartitionExitDelay"
 	case "657":
 		str = "PartitionEntryDelay"
+	case "658":
+		str = "KeypadLockout"
+	case "659":
+		str = "PartitionFailedToArm"
+	case "660":
+		str = "PartitionOutputInProgress"
+	case "663":
+		str = "PartitionChimeEnabled"
+	case "664":
+		str = "PartitionChimeDisabled"
+	case "670":
+		str = "InvalidAccessCode"
+	case "671":
+		str = "FunctionNotAvailable"
+	case "672":
+		str = "FailureToArm"
 	case "673":
 		str = "PartitionBusy"
+	case "674":
+		str = "SystemArmingInProgress"
+	case "680":
+		str = "InstallerMode"
+	case "700":
+		str = "PartitionUserClosing"
 	case "701":
 		str = "PartitionSpecialClosing"
+	case "702":
+		str = "PartitionPartialClosing"
+	case "750":
+		str = "PartitionUserOpening"
+	case "751":
+		str = "PartitionSpecialOpening"
+	case "814":
+		str = "FTCTrouble"
+	case "816":
+		str = "BufferNearFull"
 	case "840":
 		str = "TroubleOn"
 	case "841":
 		str = "TroubleOff"
+	case "842":
+		str = "FireTroubleAlarm"
+	case "843":
+		str = "FireTroubleAlarmRestore"
 	case "900":
 		str = "CodeRequired"
+	case "912":
+		str = "OutputPressed"
+	case "921":
+		str = "MasterCodeRequired"
+	case "922":
+		str = "InstallerCodeRequired"
 	default:
 		str = "UNKNOWN"
 	}
 	return fmt.Sprintf("{%s : %s : %s}", c.Code, str, c.Data)
 }
 
+// ProtocolError is reported when a frame received from the Envisalink is
+// malformed, or its data is not valid for its command code. Code is empty if
+// the frame could not be parsed at all.
+type ProtocolError struct {
+	Code  string
+	Frame string
+	Err   error
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("protocol error in frame %q: %v", e.Frame, e.Err)
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+var ErrInvalidFrame = errors.New("invalid frame")
+var ErrInvalidChecksum = errors.New("invalid checksum")
+
+// NewCommandFromBytes parses a frame received from the Envisalink: a 3 digit
+// command code, its data and a 2 digit hex checksum. The line ending may be
+// CR LF or a bare LF, or missing entirely, and surrounding whitespace and NUL
+// bytes are ignored. Any other malformed input, such as a partial line or
+// line noise, is reported as a *ProtocolError.
 func NewCommandFromBytes(p []byte) (*Command, error) {
-	if len(p) < 7 {
-		return nil, errors.New("invalid command")
+	p = bytes.Trim(p, " \t\r\n\x00")
+	if len(p) < 5 {
+		return nil, &ProtocolError{Frame: string(p), Err: ErrInvalidFrame}
+	}
+	for i, b := range p {
+		if b < 0x20 || b > 0x7e || (i < 3 && (b < '0' || b > '9')) {
+			return nil, &ProtocolError{Frame: string(p), Err: ErrInvalidFrame}
+		}
 	}
 	var tmp byte
-	for _, b := range p[:len(p)-4] {
+	for _, b := range p[:len(p)-2] {
 		tmp += b
 	}
-	if fmt.Sprintf("%02X", tmp) != string(p[len(p)-4:len(p)-2]) {
-		return nil, errors.New("invalid checksum")
+	if !strings.EqualFold(fmt.Sprintf("%02X", tmp), string(p[len(p)-2:])) {
+		return nil, &ProtocolError{Code: string(p[:3]), Frame: string(p), Err: ErrInvalidChecksum}
 	}
 	code := string(p[:3])
-	data := string(p[3 : len(p)-4])
+	data := string(p[3 : len(p)-2])
 	cmd := &Command{Code: code, Data: data}
 	return cmd, nil
 }
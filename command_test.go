@@ -18,3 +18,18 @@ func TestNewCommandFromBytes(t *testing.T) {
 		t.Error("expected bad checksum")
 	}
 }
+
+func TestNewCommandFromBytesMalformed(t *testing.T) {
+	for _, p := range []string{"5053CD\n", "5053CD", "\x005053cd\r\n"} {
+		cmd, err := NewCommandFromBytes([]byte(p))
+		if err != nil || cmd.Code != "505" || cmd.Data != "3" {
+			t.Errorf("%q: expected 5053, got %v %v", p, cmd, err)
+		}
+	}
+	for _, p := range []string{"", "\r\n", "3CD\r\n", "50\r\n", "x053CD\r\n", "505\xff3CD\r\n", "5053ZZ\r\n"} {
+		_, err := NewCommandFromBytes([]byte(p))
+		if _, ok := err.(*ProtocolError); !ok {
+			t.Errorf("%q: expected ProtocolError, got %v", p, err)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package etpi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Controller keeps partitions in a desired arm state, arming and disarming
+// them through a Panel until the panel reports that state.
+type Controller interface {
+	// Set sets the desired arm mode of a partition, or 0 for disarmed, and
+	// arms or disarms it as needed. It returns once the desired state is
+	// recorded; the outcome is reported to the drift and error callbacks.
+	Set(partition int, mode ArmMode) error
+
+	// Desired returns the desired arm mode of a partition, and whether the
+	// partition is kept in it.
+	Desired(partition int) (ArmMode, bool)
+
+	// Release stops keeping a partition in its desired state.
+	Release(partition int)
+
+	// Stop releases all partitions.
+	Stop()
+
+	// OnDrift sets the callback for when a partition leaves its desired
+	// state other than by Set, e.g. when it is disarmed at a keypad. The
+	// partition is then kept in its new state rather than changed back.
+	OnDrift(func(partition int, desired ArmMode, actual ArmMode))
+
+	// OnError sets the callback for when a partition cannot be brought to
+	// its desired state, with a *ControlError. The partition is then
+	// released.
+	OnError(func(error))
+}
+
+var ErrFailedToArm = errors.New("partition failed to arm")
+var ErrPartitionBusy = errors.New("partition busy")
+
+// errExitDelayCancelled is returned by controller.attempt when the partition
+// is disarmed before it is armed, e.g. during the exit delay.
+var errExitDelayCancelled = errors.New("exit delay cancelled")
+
+// ControlError is reported when a Controller gives up on bringing a partition
+// to its desired state.
+type ControlError struct {
+	Partition int
+	Desired   ArmMode
+	Err       error
+	// Ready is the readiness of the partition if it could not be armed, or
+	// nil.
+	Ready *ReadyReport
+}
+
+func (e *ControlError) Error() string {
+	action := fmt.Sprintf("arm %v", e.Desired)
+	if e.Desired == 0 {
+		action = "disarm"
+	}
+	msg := fmt.Sprintf("could not %s partition %d: %v", action, e.Partition, e.Err)
+	if e.Ready != nil && !e.Ready.Ready {
+		msg += " (" + e.Ready.String() + ")"
+	}
+	return msg
+}
+
+func (e *ControlError) Unwrap() error {
+	return e.Err
+}
+
+type controller struct {
+	sync.Mutex
+	panel    Panel
+	log      Logger
+	confirm  time.Duration
+	attempts int
+	retry    time.Duration
+	desired  map[int]ArmMode
+	cancel   map[int]context.CancelFunc
+	onDrift  func(int, ArmMode, ArmMode)
+	onError  func(error)
+}
+
+// NewController creates a Controller of the partitions of p. The logger,
+// confirm timeout and arm retries are taken from the options (see
+// WithArmRetry).
+func NewController(p Panel, opts ...Option) Controller {
+	cfg := newConfig(opts)
+	return &controller{
+		panel:    p,
+		log:      cfg.logger,
+		confirm:  cfg.confirm,
+		attempts: cfg.armAttempts,
+		retry:    cfg.armRetry,
+		desired:  make(map[int]ArmMode),
+		cancel:   make(map[int]context.CancelFunc),
+	}
+}
+
+func (c *controller) Set(partition int, mode ArmMode) error {
+	if partition < 1 || partition > len(c.panel.Status().Partitions) {
+		return ErrInvalidPartition
+	}
+	if mode < 0 || mode > ArmForce {
+		return ErrInvalidArmMode
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.Lock()
+	if stop := c.cancel[partition]; stop != nil {
+		stop()
+	}
+	c.desired[partition] = mode
+	c.cancel[partition] = cancel
+	c.Unlock()
+	go c.run(ctx, partition, mode)
+	return nil
+}
+
+func (c *controller) Desired(partition int) (ArmMode, bool) {
+	c.Lock()
+	defer c.Unlock()
+	mode, ok := c.desired[partition]
+	return mode, ok
+}
+
+func (c *controller) Release(partition int) {
+	c.Lock()
+	defer c.Unlock()
+	if stop := c.cancel[partition]; stop != nil {
+		stop()
+	}
+	delete(c.desired, partition)
+	delete(c.cancel, partition)
+}
+
+func (c *controller) Stop() {
+	c.Lock()
+	defer c.Unlock()
+	for partition, stop := range c.cancel {
+		stop()
+		delete(c.desired, partition)
+		delete(c.cancel, partition)
+	}
+}
+
+func (c *controller) OnDrift(f func(int, ArmMode, ArmMode)) {
+	c.Lock()
+	c.onDrift = f
+	c.Unlock()
+}
+
+func (c *controller) OnError(f func(error)) {
+	c.Lock()
+	c.onError = f
+	c.Unlock()
+}
+
+// run brings a partition to mode, then watches it for drift until ctx is
+// cancelled.
+func (c *controller) run(ctx context.Context, partition int, mode ArmMode) {
+	i := partition - 1
+	for {
+		err := c.converge(ctx, partition, mode)
+		if ctx.Err() != nil {
+			return
+		}
+		var s *PanelStatus
+		if err == errExitDelayCancelled {
+			s = c.panel.Status()
+		} else if err != nil {
+			c.fail(ctx, partition, mode, err)
+			return
+		} else {
+			s, err = c.panel.WaitFor(ctx, func(s *PanelStatus) bool {
+				return s.Partitions[i].ArmMode != mode
+			})
+			if err != nil {
+				return
+			}
+		}
+		actual := s.Partitions[i].ArmMode
+		c.Lock()
+		if ctx.Err() != nil {
+			c.Unlock()
+			return
+		}
+		c.desired[partition] = actual
+		onDrift := c.onDrift
+		c.Unlock()
+		c.log.Warn("partition left its desired state", "partition", partition, "desired", mode, "actual", actual)
+		if onDrift != nil {
+			onDrift(partition, mode, actual)
+		}
+		mode = actual
+	}
+}
+
+// converge attempts to bring a partition to mode, retrying when the panel is
+// busy or does not respond.
+func (c *controller) converge(ctx context.Context, partition int, mode ArmMode) error {
+	for attempt := 1; ; attempt++ {
+		err := c.attempt(ctx, partition, mode)
+		if err == nil || ctx.Err() != nil || !transient(err) || attempt >= c.attempts {
+			return err
+		}
+		c.log.Warn("retrying partition arm state", "partition", partition, "mode", mode, "attempt", attempt, "err", err)
+		t := time.NewTimer(c.retry)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// attempt arms or disarms a partition once. Arming is accepted when the exit
+// delay starts, and complete when the partition is armed after it.
+func (c *controller) attempt(ctx context.Context, partition int, mode ArmMode) error {
+	i := partition - 1
+	s := c.panel.Status()
+	if reached(s, i, mode) {
+		return nil
+	}
+	prior := s.Partition[i]
+	sent := time.Now()
+	var err error
+	if mode == 0 {
+		err = c.panel.Disarm(partition)
+	} else {
+		err = c.panel.Arm(partition, mode)
+	}
+	if err != nil {
+		return err
+	}
+
+	confirm, cancel := context.WithTimeout(ctx, c.confirm)
+	s, err = c.panel.WaitFor(confirm, func(s *PanelStatus) bool {
+		done, _ := outcome(s, i, mode, sent, prior)
+		return done || (mode != 0 && s.Partitions[i].ExitDelay)
+	})
+	cancel()
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return ErrNotConfirmed
+	}
+	if done, err := outcome(s, i, mode, sent, prior); done {
+		return err
+	}
+
+	s, err = c.panel.WaitFor(ctx, func(s *PanelStatus) bool {
+		done, _ := outcome(s, i, mode, sent, prior)
+		return done || !s.Partitions[i].ExitDelay
+	})
+	if err != nil {
+		return err
+	}
+	if done, err := outcome(s, i, mode, sent, prior); done {
+		return err
+	}
+	if armed := s.Partitions[i].ArmMode; armed != 0 {
+		return &ArmModeError{Partition: partition, Requested: mode, Armed: armed}
+	}
+	return errExitDelayCancelled
+}
+
+// fail releases a partition that could not be brought to mode, and reports
+// err.
+func (c *controller) fail(ctx context.Context, partition int, mode ArmMode, err error) {
+	cerr := &ControlError{Partition: partition, Desired: mode, Err: err}
+	if mode != 0 {
+		cerr.Ready, _ = c.panel.ReadyToArm(partition)
+	}
+	c.Lock()
+	if ctx.Err() != nil {
+		c.Unlock()
+		return
+	}
+	c.cancel[partition]()
+	delete(c.desired, partition)
+	delete(c.cancel, partition)
+	onError := c.onError
+	c.Unlock()
+	c.log.Error("could not control partition", "err", cerr)
+	if onError != nil {
+		onError(cerr)
+	}
+}
+
+// reached returns whether partition i of s is in mode, and not in its exit
+// delay if mode is disarmed.
+func reached(s *PanelStatus, i int, mode ArmMode) bool {
+	state := s.Partitions[i]
+	return state.ArmMode == mode && (mode != 0 || !state.ExitDelay)
+}
+
+// outcome returns whether the attempt to bring partition i to mode, sent at
+// sent when its status was prior, is over according to s, and its error if it
+// failed. A status is only taken as the answer once it changed after sent, as
+// any partition event updates the partition.
+func outcome(s *PanelStatus, i int, mode ArmMode, sent time.Time, prior PartitionStatus) (bool, error) {
+	if reached(s, i, mode) {
+		return true, nil
+	}
+	if !s.PartitionUpdated[i].After(sent) || s.Partition[i] == prior {
+		return false, nil
+	}
+	switch s.Partition[i] {
+	case PartitionStatusFailedToArm:
+		return true, ErrFailedToArm
+	case PartitionStatusBusy:
+		return true, ErrPartitionBusy
+	case PartitionStatusDisarmed:
+		if mode != 0 {
+			return true, errExitDelayCancelled
+		}
+	}
+	return false, nil
+}
+
+// transient returns whether err may not recur if the request is retried.
+func transient(err error) bool {
+	switch err {
+	case ErrPartitionBusy, ErrNotConfirmed, ErrTimeout, ErrCommandError, ErrNotConnected, ErrLinkDead:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package etpi
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type drift struct {
+	partition       int
+	desired, actual ArmMode
+}
+
+func TestController(t *testing.T) {
+	p, f := connectPanel(t)
+	defer p.Disconnect()
+
+	c := NewController(p,
+		WithArmRetry(3, 10*time.Millisecond),
+		WithConfirmTimeout(200*time.Millisecond),
+		WithLogger(NewStdLogger(nil, LevelError)),
+	)
+	defer c.Stop()
+	drifts := make(chan drift, 1)
+	c.OnDrift(func(partition int, desired, actual ArmMode) {
+		drifts <- drift{partition, desired, actual}
+	})
+	errs := make(chan error, 1)
+	c.OnError(func(err error) { errs <- err })
+
+	if err := c.Set(9, ArmAway); err != ErrInvalidPartition {
+		t.Errorf("expected ErrInvalidPartition, got %v", err)
+	}
+	if err := c.Set(1, ArmMode(9)); err != ErrInvalidArmMode {
+		t.Errorf("expected ErrInvalidArmMode, got %v", err)
+	}
+
+	// A busy partition is armed again.
+	if err := c.Set(1, ArmAway); err != nil {
+		t.Fatal(err)
+	}
+	f.waitFor(t, CommandPartitionArmControlAway, 1)
+	f.send(Command{Code: CommandPartitionBusy, Data: "1"})
+	f.waitFor(t, CommandPartitionArmControlAway, 2)
+	f.send(Command{Code: CommandPartitionExitDelay, Data: "1"})
+	f.send(Command{Code: CommandPartitionArmed, Data: "10"})
+	waitStatus(t, p, func(s *PanelStatus) bool { return s.Partitions[0].ArmMode == ArmAway })
+
+	// Disarming at the keypad is reported as drift, and kept.
+	f.send(Command{Code: CommandPartitionDisarmed, Data: "1"})
+	select {
+	case d := <-drifts:
+		if d != (drift{1, ArmAway, 0}) {
+			t.Errorf("unexpected drift %+v", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected drift to be reported")
+	}
+	if mode, ok := c.Desired(1); !ok || mode != 0 {
+		t.Errorf("expected disarmed to be desired, got %v %v", mode, ok)
+	}
+	if n := f.count(CommandPartitionArmControlAway); n != 2 {
+		t.Errorf("expected partition not to be armed again, got %d arm commands", n)
+	}
+
+	// Failing to arm releases the partition.
+	f.send(Command{Code: CommandZoneOpen, Data: "003"})
+	if err := c.Set(1, ArmStay); err != nil {
+		t.Fatal(err)
+	}
+	f.waitFor(t, CommandPartitionArmControlStay, 1)
+	f.send(Command{Code: CommandPartitionFailedToArm, Data: "1"})
+	select {
+	case err := <-errs:
+		var e *ControlError
+		if !errors.As(err, &e) || e.Err != ErrFailedToArm || e.Ready == nil || len(e.Ready.Open) != 1 {
+			t.Errorf("expected ControlError with readiness, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected failure to be reported")
+	}
+	if _, ok := c.Desired(1); ok {
+		t.Error("expected partition to be released")
+	}
+}
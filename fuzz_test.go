@@ -0,0 +1,53 @@
+//go:build go1.18
+// +build go1.18
+
+package etpi
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzNewCommandFromBytes(f *testing.F) {
+	for _, seed := range []string{
+		"5053CD\r\n",
+		"5053CD\n",
+		"6011001CB",
+		"65211C1\r\n",
+		"51081\r\n",
+		"\x00\x00609",
+		"\r\n",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, p []byte) {
+		cmd, err := NewCommandFromBytes(p)
+		if err != nil {
+			if _, ok := err.(*ProtocolError); !ok {
+				t.Fatalf("expected ProtocolError, got %v", err)
+			}
+			return
+		}
+		// A frame that parses must round trip.
+		var buf bytes.Buffer
+		cmd.WriteTo(&buf)
+		again, err := NewCommandFromBytes(buf.Bytes())
+		if err != nil || *again != *cmd {
+			t.Fatalf("%v did not round trip: %v %v", cmd, again, err)
+		}
+	})
+}
+
+func FuzzClientHandle(f *testing.F) {
+	for _, seed := range []string{"601", "6520", "510", "5630000000", "550", "9122", "505"} {
+		f.Add(seed[:3], seed[3:])
+	}
+	f.Fuzz(func(t *testing.T, code string, data string) {
+		// No handlers are set and there is no connection, as when a Client
+		// is used directly; handle must not panic either way.
+		c := NewClient(WithLogger(NewStdLogger(nil, LevelError+1))).(*client)
+		var buf bytes.Buffer
+		Command{Code: code, Data: data}.WriteTo(&buf)
+		c.handle(buf.Bytes())
+	})
+}
@@ -0,0 +1,76 @@
+package etpi
+
+import (
+	"sync"
+	"time"
+)
+
+// Health describes the liveness of the connection to the Envisalink module.
+type Health struct {
+	// Connected reports whether the TPI session is currently up, and
+	// ConnectedSince when it was established.
+	Connected      bool
+	ConnectedSince time.Time
+
+	// LastReceived and LastSent are the times the last frame was received
+	// from and sent to the Envisalink.
+	LastReceived time.Time
+	LastSent     time.Time
+
+	// Latency is the round trip time of the last acknowledged command.
+	Latency time.Duration
+
+	// ConsecutiveFailures is the number of commands in a row that were not
+	// acknowledged in time. It is reset by any acknowledged command.
+	ConsecutiveFailures int
+}
+
+type health struct {
+	sync.Mutex
+	h Health
+}
+
+func (h *health) connected() {
+	h.Lock()
+	defer h.Unlock()
+	h.h = Health{Connected: true, ConnectedSince: time.Now()}
+}
+
+func (h *health) disconnected() {
+	h.Lock()
+	h.h.Connected = false
+	h.Unlock()
+}
+
+func (h *health) sent() time.Time {
+	h.Lock()
+	defer h.Unlock()
+	h.h.LastSent = time.Now()
+	return h.h.LastSent
+}
+
+func (h *health) received() {
+	h.Lock()
+	h.h.LastReceived = time.Now()
+	h.Unlock()
+}
+
+func (h *health) responded(sent time.Time) {
+	h.Lock()
+	h.h.Latency = time.Since(sent)
+	h.h.ConsecutiveFailures = 0
+	h.Unlock()
+}
+
+func (h *health) failed() int {
+	h.Lock()
+	defer h.Unlock()
+	h.h.ConsecutiveFailures++
+	return h.h.ConsecutiveFailures
+}
+
+func (h *health) snapshot() Health {
+	h.Lock()
+	defer h.Unlock()
+	return h.h
+}
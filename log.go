@@ -0,0 +1,101 @@
+package etpi
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+)
+
+// Logger is the interface used by Panel and Client to report what they are
+// doing. Each method takes a message followed by alternating key/value pairs,
+// so a *slog.Logger from the standard library satisfies it directly.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// Level is the severity of a log message. The values match those of
+// log/slog.
+type Level int
+
+const (
+	LevelDebug Level = -4
+	LevelInfo  Level = 0
+	LevelWarn  Level = 4
+	LevelError Level = 8
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	default:
+		return fmt.Sprintf("LEVEL(%d)", int(l))
+	}
+}
+
+type stdLogger struct {
+	l     *log.Logger
+	level Level
+}
+
+// NewStdLogger returns a Logger that writes messages at or above level to l.
+// Key/value pairs are appended to the message as key=value. If l is nil the
+// standard logger of the log package is used.
+func NewStdLogger(l *log.Logger, level Level) Logger {
+	return &stdLogger{l: l, level: level}
+}
+
+func (s *stdLogger) Debug(msg string, args ...interface{}) { s.log(LevelDebug, msg, args) }
+func (s *stdLogger) Info(msg string, args ...interface{})  { s.log(LevelInfo, msg, args) }
+func (s *stdLogger) Warn(msg string, args ...interface{})  { s.log(LevelWarn, msg, args) }
+func (s *stdLogger) Error(msg string, args ...interface{}) { s.log(LevelError, msg, args) }
+
+func (s *stdLogger) log(level Level, msg string, args []interface{}) {
+	if level < s.level {
+		return
+	}
+	buf := bytes.NewBufferString(level.String())
+	buf.WriteByte(' ')
+	buf.WriteString(msg)
+	for i := 0; i < len(args); i += 2 {
+		if i+1 < len(args) {
+			fmt.Fprintf(buf, " %v=%v", args[i], args[i+1])
+		} else {
+			fmt.Fprintf(buf, " !BADKEY=%v", args[i])
+		}
+	}
+	if s.l == nil {
+		log.Print(buf.String())
+		return
+	}
+	s.l.Print(buf.String())
+}
+
+// redacted returns a copy of cmd with any password or user code in its data
+// replaced so that it can be logged safely.
+func (cmd Command) redacted() Command {
+	switch cmd.Code {
+	case CommandLogin, CommandCode:
+		cmd.Data = mask(cmd.Data)
+	case CommandPartitionArmControlWithCode, CommandPartitionDisarmControl, CommandKeystroke:
+		// The partition number precedes the user code or keys, which
+		// may include codes when programming them.
+		if len(cmd.Data) > 1 {
+			cmd.Data = cmd.Data[:1] + mask(cmd.Data[1:])
+		}
+	}
+	return cmd
+}
+
+func mask(s string) string {
+	return string(bytes.Repeat([]byte{'*'}, len(s)))
+}
@@ -0,0 +1,37 @@
+package etpi
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestStdLoggerLevel(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewStdLogger(log.New(&buf, "", 0), LevelInfo)
+	l.Debug("hidden")
+	l.Info("connected", "host", "localhost:4025")
+	if got := buf.String(); got != "INFO connected host=localhost:4025\n" {
+		t.Errorf("unexpected log output %q", got)
+	}
+}
+
+func TestRedaction(t *testing.T) {
+	var buf bytes.Buffer
+	c := NewClient(
+		WithLogger(NewStdLogger(log.New(&buf, "", 0), LevelDebug)),
+		WithRedaction(true),
+	).(*client)
+	c.logFrame("->", Command{Code: CommandLogin, Data: "user"})
+	c.logFrame("->", Command{Code: CommandPartitionDisarmControl, Data: "11234"})
+	c.logFrame("->", Command{Code: CommandPartitionArmControlWithCode, Data: "11234"})
+	c.logFrame("->", Command{Code: CommandCode, Data: "1234"})
+	out := buf.String()
+	if strings.Contains(out, "user") || strings.Contains(out, "1234") {
+		t.Errorf("secrets logged in the clear: %q", out)
+	}
+	if !strings.Contains(out, "PartitionDisarmControl : 1****") {
+		t.Errorf("expected partition to be kept: %q", out)
+	}
+}
@@ -0,0 +1,104 @@
+package etpi
+
+import "sync"
+
+// Metrics is a snapshot of the counters kept for the connection to the
+// Envisalink module. Counters are cumulative for the lifetime of the Client,
+// across reconnects.
+type Metrics struct {
+	// Connected reports whether the TPI session is currently up.
+	Connected bool
+
+	// Connects is the number of successful connections made, and
+	// Reconnects the number of those made after the first.
+	Connects   uint64
+	Reconnects uint64
+
+	// CommandsSent is the number of commands written to the Envisalink.
+	CommandsSent uint64
+
+	// Acks is the number of 500 Command Acknowledge responses received.
+	Acks uint64
+
+	// CommandErrors is the number of 501 Command Error (bad checksum)
+	// responses received (see ErrCommandError).
+	CommandErrors uint64
+
+	// SystemErrors counts 502 System Error responses keyed by the 3 digit
+	// error code (e.g., "024" for ErrAPISystemNotReadytoArm).
+	SystemErrors map[string]uint64
+
+	// ProtocolErrors is the number of malformed frames received and
+	// discarded (see ProtocolError).
+	ProtocolErrors uint64
+
+	// FramesReceived counts every valid frame received keyed by command
+	// code (e.g., "609").
+	FramesReceived map[string]uint64
+}
+
+type metrics struct {
+	sync.Mutex
+	m Metrics
+}
+
+func newMetrics() *metrics {
+	return &metrics{m: Metrics{
+		SystemErrors:   make(map[string]uint64),
+		FramesReceived: make(map[string]uint64),
+	}}
+}
+
+func (m *metrics) connected(up bool) {
+	m.Lock()
+	defer m.Unlock()
+	if up {
+		if m.m.Connects > 0 {
+			m.m.Reconnects++
+		}
+		m.m.Connects++
+	}
+	m.m.Connected = up
+}
+
+func (m *metrics) sent() {
+	m.Lock()
+	m.m.CommandsSent++
+	m.Unlock()
+}
+
+func (m *metrics) protocolError() {
+	m.Lock()
+	m.m.ProtocolErrors++
+	m.Unlock()
+}
+
+func (m *metrics) received(cmd Command) {
+	m.Lock()
+	defer m.Unlock()
+	m.m.FramesReceived[cmd.Code]++
+	switch cmd.Code {
+	case CommandAck:
+		m.m.Acks++
+	case CommandCommandError:
+		m.m.CommandErrors++
+	case CommandSystemError:
+		m.m.SystemErrors[cmd.Data]++
+	}
+}
+
+// snapshot returns a copy of the current counters.
+func (m *metrics) snapshot() Metrics {
+	m.Lock()
+	defer m.Unlock()
+	s := m.m
+	s.SystemErrors = make(map[string]uint64, len(m.m.SystemErrors))
+	for k, v := range m.m.SystemErrors {
+		s.SystemErrors[k] = v
+	}
+	s.FramesReceived = make(map[string]uint64, len(m.m.FramesReceived))
+	for k, v := range m.m.FramesReceived {
+		s.FramesReceived[k] = v
+	}
+	return s
+}
@@ -0,0 +1,261 @@
+package etpi
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// Option configures a Panel or Client when passed to NewPanel or NewClient.
+type Option func(*config)
+
+type config struct {
+	logger      Logger
+	redact      bool
+	dialer      Dialer
+	transport   func(string) (io.ReadWriteCloser, error)
+	dialTimeout time.Duration
+	ackTimeout  time.Duration
+	confirm     time.Duration
+	zones       int
+	partitions  int
+	clockSync   bool
+	master      Secret
+	installer   Secret
+	clockDrift  time.Duration
+	clockResync time.Duration
+	keepAlive   time.Duration
+	maxMissed   int
+	settleTime  time.Duration
+	reconcile   time.Duration
+	armAttempts int
+	armRetry    time.Duration
+}
+
+func newConfig(opts []Option) *config {
+	cfg := &config{
+		logger:      NewStdLogger(nil, LevelInfo),
+		dialTimeout: time.Second,
+		ackTimeout:  time.Second,
+		confirm:     5 * time.Second,
+		zones:       maxZones,
+		partitions:  maxPartitions,
+		clockSync:   true,
+		clockDrift:  2 * time.Minute,
+		clockResync: 24 * time.Hour,
+		keepAlive:   time.Minute,
+		maxMissed:   3,
+		settleTime:  500 * time.Millisecond,
+		reconcile:   15 * time.Minute,
+		armAttempts: 3,
+		armRetry:    5 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return cfg
+}
+
+// WithLogger sets the Logger used to report connection activity, frames sent
+// and received (at debug level) and errors. The default logs at info level
+// and above to the standard logger of the log package.
+func WithLogger(l Logger) Option {
+	return func(c *config) {
+		c.logger = l
+	}
+}
+
+// WithRedaction masks passwords and user codes (e.g., in the 005 login, 033
+// arm, 040 disarm, 071 keystroke and 200 code send commands) before frames
+// are logged.
+func WithRedaction(redact bool) Option {
+	return func(c *config) {
+		c.redact = redact
+	}
+}
+
+// Dialer opens the network connection to the Envisalink module. *net.Dialer
+// satisfies it.
+type Dialer interface {
+	Dial(network, address string) (net.Conn, error)
+}
+
+// DialerFunc adapts an ordinary function, such as the Dial method of an SSH
+// client, to a Dialer.
+type DialerFunc func(network, address string) (net.Conn, error)
+
+// Dial calls f(network, address).
+func (f DialerFunc) Dial(network, address string) (net.Conn, error) {
+	return f(network, address)
+}
+
+// WithDialer sets the Dialer used to connect to the Envisalink, e.g. to route
+// the connection through a proxy, TLS tunnel or SSH connection. The timeout set
+// by WithDialTimeout is not applied to a custom Dialer.
+func WithDialer(d Dialer) Option {
+	return func(c *config) {
+		c.dialer = d
+	}
+}
+
+// WithTransport sets the function used by Connect to open the connection to
+// the Envisalink, in place of a network Dialer. The address passed to
+// Connect is handed to open as is, so it can name anything the transport
+// understands, e.g. a serial device path. It takes precedence over
+// WithDialer.
+func WithTransport(open func(address string) (io.ReadWriteCloser, error)) Option {
+	return func(c *config) {
+		c.transport = open
+	}
+}
+
+// WithDialTimeout sets how long to wait for the TCP connection to the
+// Envisalink to be established. The default is 1 second.
+func WithDialTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.dialTimeout = d
+	}
+}
+
+// WithAckTimeout sets how long to wait for the Envisalink to acknowledge a
+// command before Send returns an error. The default is 1 second.
+func WithAckTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.ackTimeout = d
+	}
+}
+
+// WithConfirmTimeout sets how long to wait for the panel to report that an
+// acknowledged command took effect, e.g. that the chime was toggled. The
+// default is 5 seconds.
+func WithConfirmTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.confirm = d
+	}
+}
+
+// maxZones and maxPartitions are the most zones and partitions the TPI can
+// report.
+const (
+	maxZones      = 64
+	maxPartitions = 8
+)
+
+// WithZones sets the number of zones supported by the alarm panel (e.g., 16
+// for a PC1616), from 1 to 64. Values out of range are clamped to it. The
+// default is 64, the maximum for a PC1864.
+func WithZones(n int) Option {
+	return func(c *config) {
+		c.zones = clamp(n, 1, maxZones)
+	}
+}
+
+// WithPartitions sets the number of partitions supported by the alarm panel,
+// from 1 to 8. Values out of range are clamped to it. The default is 8.
+func WithPartitions(n int) Option {
+	return func(c *config) {
+		c.partitions = clamp(n, 1, maxPartitions)
+	}
+}
+
+func clamp(n, min, max int) int {
+	if n < min {
+		return min
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
+
+// WithClockSync sets whether Panel.Connect sets the date and time of the
+// alarm panel to the host clock, and whether the panel clock is corrected
+// while connected (see WithClockDrift and WithClockResync). It is enabled by
+// default.
+func WithClockSync(sync bool) Option {
+	return func(c *config) {
+		c.clockSync = sync
+	}
+}
+
+// WithClockDrift sets how far the panel clock reported by the time broadcast
+// may drift from the host clock before it is set again. The default is 2
+// minutes.
+func WithClockDrift(threshold time.Duration) Option {
+	return func(c *config) {
+		c.clockDrift = threshold
+	}
+}
+
+// WithClockResync sets how often the panel clock is set to the host clock
+// regardless of drift. The default is every 24 hours, and an interval of 0
+// disables the periodic resync.
+func WithClockResync(interval time.Duration) Option {
+	return func(c *config) {
+		c.clockResync = interval
+	}
+}
+
+// WithKeepAlive sets how often the client sends a 000 poll to the Envisalink
+// to check that the link is alive. The default is every minute, and an
+// interval of 0 disables the keep-alive.
+func WithKeepAlive(interval time.Duration) Option {
+	return func(c *config) {
+		c.keepAlive = interval
+	}
+}
+
+// WithMaxMissed sets how many keep-alive polls in a row may go unanswered
+// before the link is declared dead and the connection closed. The default
+// is 3.
+func WithMaxMissed(n int) Option {
+	return func(c *config) {
+		c.maxMissed = n
+	}
+}
+
+// WithMasterCode sets the Secret supplying the master code, sent when the
+// panel asks for it (921). Without it, such requests fail with a
+// CodeRequiredError.
+func WithMasterCode(s Secret) Option {
+	return func(c *config) {
+		c.master = s
+	}
+}
+
+// WithInstallerCode sets the Secret supplying the installer's code, sent when
+// the panel asks for it (922). Without it, such requests fail with a
+// CodeRequiredError.
+func WithInstallerCode(s Secret) Option {
+	return func(c *config) {
+		c.installer = s
+	}
+}
+
+// WithSettleTime sets how long the panel must be quiet after a status report
+// is requested before the report is considered complete (see Panel.Refresh).
+// The default is 500ms.
+func WithSettleTime(d time.Duration) Option {
+	return func(c *config) {
+		c.settleTime = d
+	}
+}
+
+// WithReconcile sets how often the panel status is refreshed while connected,
+// emitting events for any changes that were missed. The default is every 15
+// minutes, and an interval of 0 disables the periodic refresh.
+func WithReconcile(interval time.Duration) Option {
+	return func(c *config) {
+		c.reconcile = interval
+	}
+}
+
+// WithArmRetry sets how many times a Controller attempts to arm or disarm a
+// partition when the panel is busy (673) or does not respond, and how long it
+// waits between attempts. The default is 3 attempts, 5 seconds apart.
+func WithArmRetry(attempts int, delay time.Duration) Option {
+	return func(c *config) {
+		c.armAttempts = attempts
+		c.armRetry = delay
+	}
+}
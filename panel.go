@@ -1,10 +1,11 @@
 package etpi
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"log"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -35,19 +36,60 @@ type Panel interface {
 
 	// Connect opens the connection to the Envisalink panel, logs in using
 	// the supplied password, and upon a successful connection will set the
-	// correct date/time of the alarm system.
+	// correct date/time of the alarm system. A failed login is returned as
+	// ErrBadPassword, ErrLoginTimeout or ErrSessionInUse, and ErrTimeout if
+	// the panel does not report its status within the confirm timeout (see
+	// WithConfirmTimeout).
 	Connect(host string, pwd string, code string) error
 
 	// Disconnect closes the connection to the Envisalink panel.
 	Disconnect()
 
 	// Arm attempts to arm a partition according to the supplied mode
-	// (e.g., Stay, Away).
+	// (e.g., Stay, Away). It returns once the panel has acknowledged the
+	// request; the partition is armed after its exit delay, when the mode
+	// reported by the panel (652) is checked against the one requested and
+	// an *ArmModeError is reported to the error callback if they differ.
 	Arm(partition int, mode ArmMode) error
 
+	// ArmWithCode arms a partition like Arm, using the access code of a
+	// user (4 or 6 digits) rather than the code passed to Connect, so that
+	// the panel attributes the arming to that user.
+	ArmWithCode(partition int, mode ArmMode, code string) error
+
 	// Disarm attempts to disarm a partition.
 	Disarm(partition int) error
 
+	// DisarmWithCode disarms a partition with the access code of a user
+	// (4 or 6 digits) rather than the code passed to Connect.
+	DisarmWithCode(partition int, code string) error
+
+	// WaitFor blocks until cond is true of the panel status (e.g.,
+	// IsArmed, IsZoneClosed), and returns the matching status or the
+	// context's error.
+	WaitFor(ctx context.Context, cond Condition) (*PanelStatus, error)
+
+	// ReadyToArm reports whether a partition is ready to arm, listing the
+	// open, faulted and tampered zones that are not bypassed.
+	ReadyToArm(partition int) (*ReadyReport, error)
+
+	// SetUserCode programs the access code (4 or 6 digits) of a user code
+	// slot (1-95, where 40 is the master code). It requires the master
+	// code, see WithMasterCode.
+	SetUserCode(slot int, code string) error
+
+	// DeleteUserCode deletes the access code of a user code slot. It
+	// requires the master code, see WithMasterCode.
+	DeleteUserCode(slot int) error
+
+	// SetChime enables or disables the door chime of a partition, and
+	// waits for the panel to confirm the new state.
+	SetChime(partition int, on bool) error
+
+	// ActivateOutput activates one of the command outputs (1-4) of a
+	// partition, e.g. a PGM wired to a garage door opener or strobe.
+	ActivateOutput(partition int, output int) error
+
 	// SetTime sets the time for the alarm panel.
 	SetTime(time.Time) error
 
@@ -55,31 +97,223 @@ type Panel interface {
 	// occurs.
 	OnPartitionEvent(func(int, PartitionStatus))
 
+	// OnPartitionStateEvent sets a callback for whenever the state of a
+	// partition changes.
+	OnPartitionStateEvent(func(int, PartitionState))
+
 	// OnZoneEvent sets a calledback for whenever a zone event occurs.
+	// It is kept for compatibility; OnZoneStateEvent reports every change
+	// to the state of a zone.
 	OnZoneEvent(func(int, ZoneStatus))
 
+	// OnZoneStateEvent sets a callback for whenever the state of a zone
+	// changes.
+	OnZoneStateEvent(func(int, ZoneState))
+
 	// OnKeypadEvent sets a callback for whenever a keypad event occurs.
 	OnKeypadEvent(func(KeypadStatus))
 
-	// Status returns the current partition, zone, and keypad status.
+	// OnThermostatEvent sets a callback for whenever a thermostat reports
+	// a temperature or its set points.
+	OnThermostatEvent(func(int, ThermostatStatus))
+
+	// OnOutputEvent sets a callback for whenever a command output (PGM) is
+	// activated on a partition.
+	OnOutputEvent(func(partition int, output int, event OutputEvent))
+
+	// OnLifeSafetyEvent sets a callback for duress, smoke/aux alarm and fire
+	// trouble events. Unlike other callbacks it is also called for events
+	// received while connecting, and before the status is updated.
+	OnLifeSafetyEvent(func(LifeSafetyEvent))
+
+	// OnCommunicatorEvent sets a callback for phone line ring detect and
+	// communicator trouble events.
+	OnCommunicatorEvent(func(CommunicatorEvent))
+
+	// OnTroubleEvent sets a callback for whenever the panel reports a
+	// trouble condition or that it has cleared.
+	OnTroubleEvent(func(bool))
+
+	// OnError sets a callback for errors reported by the panel outside of
+	// a command, such as a CodeRequiredError when it asks for a master or
+	// installer code that is not configured.
+	OnError(func(error))
+
+	// OnChimeEvent sets a callback for whenever the door chime of a
+	// partition is enabled or disabled.
+	OnChimeEvent(func(partition int, on bool))
+
+	// Refresh requests a status report from the panel and waits until the
+	// zone, partition and keypad states it sends have settled, so that
+	// Status is consistent, emitting events for any that were missed.
+	Refresh(ctx context.Context) error
+
+	// Status returns a snapshot of the current partition, zone, and keypad
+	// status. The snapshot is a copy that is safe to use from any goroutine
+	// and is not modified by subsequent events.
 	Status() *PanelStatus
 
-	// Poll queries the Envisalink module to send its latest update.
+	// Poll sends a keep-alive poll to the Envisalink module, returning an
+	// error if it is not acknowledged.
 	Poll() error
+
+	// Health returns a report on the liveness of the connection to the
+	// Envisalink module.
+	Health() Health
+
+	// OnDisconnect sets a callback for whenever the connection to the
+	// Envisalink module is lost, other than by a call to Disconnect.
+	OnDisconnect(func(error))
+
+	// Metrics returns a snapshot of the counters for the connection to the
+	// Envisalink module.
+	Metrics() Metrics
 }
 
+var ErrInvalidPartition = errors.New("invalid partition")
+var ErrInvalidOutput = errors.New("invalid command output, must be 1-4")
+var ErrNotConfirmed = errors.New("change not confirmed by panel")
+var ErrInvalidArmMode = errors.New("invalid arm mode")
+var ErrForceArmUnavailable = errors.New("partition not ready to force arm")
+
 type ArmMode int
 
 const (
 	ArmAway = iota + 1
 	ArmStay
+	// ArmNoEntryDelay is away with no entry delay, also known as max.
 	ArmNoEntryDelay
+	// ArmInstant is stay with no entry delay. It is entered at the keypad
+	// with the code, so it fails with ErrInvalidCode if Connect was given
+	// none.
+	ArmInstant
+	// ArmNight is stay with the night zones armed as well ([*][1] once
+	// armed stay).
+	ArmNight
+	// ArmForce is away while the partition is only ready to force arm
+	// (653), leaving its open force-armable zones unarmed.
+	ArmForce
 )
 
+// ArmMax is away with no entry delay.
+const ArmMax = ArmNoEntryDelay
+
+func (m ArmMode) String() string {
+	switch m {
+	case ArmAway:
+		return "AWAY"
+	case ArmStay:
+		return "STAY"
+	case ArmNoEntryDelay:
+		return "MAX"
+	case ArmInstant:
+		return "INSTANT"
+	case ArmNight:
+		return "NIGHT"
+	case ArmForce:
+		return "FORCE"
+	case 0:
+		return "DISARMED"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// reported returns the mode the panel reports (652) when a partition is
+// armed in m, as night and force arming are not told apart from stay and
+// away.
+func (m ArmMode) reported() ArmMode {
+	switch m {
+	case ArmNight:
+		return ArmStay
+	case ArmForce:
+		return ArmAway
+	default:
+		return m
+	}
+}
+
+// ArmModeError is reported when a partition is armed in a different mode
+// than the one requested, e.g. armed stay rather than instant because an
+// exit zone was opened.
+type ArmModeError struct {
+	Partition int
+	Requested ArmMode
+	Armed     ArmMode
+}
+
+func (e *ArmModeError) Error() string {
+	return fmt.Sprintf("partition %d armed %v, requested %v", e.Partition, e.Armed, e.Requested)
+}
+
 type PanelStatus struct {
 	Zone      []ZoneStatus
 	Partition []PartitionStatus
 	Keypad    KeypadStatus
+
+	// Partitions holds the state of each partition. Unlike Partition, which
+	// only holds the last event reported for a partition, it tells e.g. that
+	// a partition in its exit delay is not ready.
+	Partitions []PartitionState
+
+	// Zones holds the state of each zone. Unlike Zone, which only holds the
+	// last event reported for a zone, it tells e.g. that a zone is both open
+	// and tampered.
+	Zones []ZoneState
+
+	// Chime holds whether the door chime of each partition is enabled, and
+	// ChimeUpdated when it was last reported. The panel only reports the
+	// chime when it changes.
+	Chime        []bool
+	ChimeUpdated []time.Time
+
+	// Duress is the time of the last duress alarm, and SmokeAlarm and
+	// FireTrouble whether a 2-wire smoke/aux alarm or fire trouble alarm is
+	// active.
+	Duress      time.Time
+	SmokeAlarm  bool
+	FireTrouble bool
+
+	// Trouble is whether the panel reports a trouble condition, and
+	// FTCTrouble whether it has failed to communicate with the monitoring
+	// station since the trouble was last cleared.
+	Trouble    bool
+	FTCTrouble bool
+
+	// Thermostat holds the readings of up to 4 EMS-100 escort thermostats.
+	Thermostat []ThermostatStatus
+
+	// Revision increases each time the status is updated, so that two
+	// snapshots can be compared to tell if anything changed between them.
+	Revision uint64
+
+	// ZoneUpdated, PartitionUpdated and KeypadUpdated hold the time each
+	// zone, partition and the keypad were last updated. A zero time means
+	// no update has been received.
+	ZoneUpdated      []time.Time
+	PartitionUpdated []time.Time
+	KeypadUpdated    time.Time
+
+	// PanelTime is the date and time of the alarm panel from its last time
+	// broadcast, to the minute, and ClockDrift how far it was ahead (or
+	// behind, if negative) of the host clock.
+	PanelTime  time.Time
+	ClockDrift time.Duration
+}
+
+// clone returns a deep copy of s.
+func (s *PanelStatus) clone() *PanelStatus {
+	c := *s
+	c.Zone = append([]ZoneStatus(nil), s.Zone...)
+	c.Zones = append([]ZoneState(nil), s.Zones...)
+	c.Partition = append([]PartitionStatus(nil), s.Partition...)
+	c.Partitions = append([]PartitionState(nil), s.Partitions...)
+	c.ZoneUpdated = append([]time.Time(nil), s.ZoneUpdated...)
+	c.PartitionUpdated = append([]time.Time(nil), s.PartitionUpdated...)
+	c.Thermostat = append([]ThermostatStatus(nil), s.Thermostat...)
+	c.Chime = append([]bool(nil), s.Chime...)
+	c.ChimeUpdated = append([]time.Time(nil), s.ChimeUpdated...)
+	return &c
 }
 
 type ZoneStatus int
@@ -159,6 +393,10 @@ func (p PartitionStatus) String() string {
 	}
 }
 
+// KeypadStatus is the state of the keypad LEDs. The boolean fields report
+// whether each LED is lit (510), and LED whether each is off, on or flashing
+// (511), which on DSC keypads means something different, e.g. a flashing
+// Trouble light.
 type KeypadStatus struct {
 	Backlight bool
 	Fire      bool
@@ -168,133 +406,868 @@ type KeypadStatus struct {
 	Memory    bool
 	Armed     bool
 	Ready     bool
+
+	LED [8]LEDState
+}
+
+// State returns the state of a keypad LED.
+func (k KeypadStatus) State(led KeypadLED) LEDState {
+	return k.LED[led]
+}
+
+// KeypadLED identifies a keypad LED, and is its bit in the 510 and 511
+// bitmasks.
+type KeypadLED int
+
+const (
+	LEDReady KeypadLED = iota
+	LEDArmed
+	LEDMemory
+	LEDBypass
+	LEDTrouble
+	LEDProgram
+	LEDFire
+	LEDBacklight
+)
+
+func (l KeypadLED) String() string {
+	switch l {
+	case LEDReady:
+		return "READY"
+	case LEDArmed:
+		return "ARMED"
+	case LEDMemory:
+		return "MEMORY"
+	case LEDBypass:
+		return "BYPASS"
+	case LEDTrouble:
+		return "TROUBLE"
+	case LEDProgram:
+		return "PROGRAM"
+	case LEDFire:
+		return "FIRE"
+	case LEDBacklight:
+		return "BACKLIGHT"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// LEDState is whether a keypad LED is off, on or flashing.
+type LEDState int
+
+const (
+	LEDOff LEDState = iota
+	LEDOn
+	LEDFlashing
+)
+
+func (s LEDState) String() string {
+	switch s {
+	case LEDOff:
+		return "OFF"
+	case LEDOn:
+		return "ON"
+	case LEDFlashing:
+		return "FLASHING"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// LifeSafetyEvent is a duress, smoke or fire event reported by the panel.
+type LifeSafetyEvent int
+
+const (
+	LifeSafetyDuress LifeSafetyEvent = iota + 1
+	LifeSafetySmokeAlarm
+	LifeSafetySmokeRestored
+	LifeSafetyFireTrouble
+	LifeSafetyFireTroubleRestored
+)
+
+func (e LifeSafetyEvent) String() string {
+	switch e {
+	case LifeSafetyDuress:
+		return "DURESS_ALARM"
+	case LifeSafetySmokeAlarm:
+		return "SMOKE_AUX_ALARM"
+	case LifeSafetySmokeRestored:
+		return "SMOKE_AUX_RESTORED"
+	case LifeSafetyFireTrouble:
+		return "FIRE_TROUBLE_ALARM"
+	case LifeSafetyFireTroubleRestored:
+		return "FIRE_TROUBLE_RESTORED"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// CommunicatorEvent is an event of the panel's phone communicator.
+type CommunicatorEvent int
+
+const (
+	// CommunicatorRingDetected is reported (560) when the phone line rings.
+	CommunicatorRingDetected CommunicatorEvent = iota + 1
+	// CommunicatorFTCTrouble is reported (814) when the panel failed to
+	// communicate with the monitoring station.
+	CommunicatorFTCTrouble
+	// CommunicatorBufferNearFull is reported (816) when the event buffer
+	// is near full because events have not been uploaded.
+	CommunicatorBufferNearFull
+)
+
+func (e CommunicatorEvent) String() string {
+	switch e {
+	case CommunicatorRingDetected:
+		return "RING_DETECTED"
+	case CommunicatorFTCTrouble:
+		return "FTC_TROUBLE"
+	case CommunicatorBufferNearFull:
+		return "BUFFER_NEAR_FULL"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// OutputEvent is the progress of a command output (PGM) activation.
+type OutputEvent int
+
+const (
+	// OutputInProgress is reported (660) while a PGM output is active.
+	OutputInProgress OutputEvent = iota + 1
+	// OutputPressed is reported (912) when a command output is activated.
+	OutputPressed
+)
+
+func (e OutputEvent) String() string {
+	switch e {
+	case OutputInProgress:
+		return "IN_PROGRESS"
+	case OutputPressed:
+		return "PRESSED"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// TemperatureKind identifies a temperature reported by a thermostat.
+type TemperatureKind int
+
+const (
+	TemperatureIndoor TemperatureKind = iota + 1
+	TemperatureOutdoor
+	TemperatureCoolSetPoint
+	TemperatureHeatSetPoint
+)
+
+func (k TemperatureKind) String() string {
+	switch k {
+	case TemperatureIndoor:
+		return "INDOOR"
+	case TemperatureOutdoor:
+		return "OUTDOOR"
+	case TemperatureCoolSetPoint:
+		return "COOL_SET_POINT"
+	case TemperatureHeatSetPoint:
+		return "HEAT_SET_POINT"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// ThermostatStatus holds the temperatures and set points reported by an
+// EMS-100 escort thermostat, in the degrees (Fahrenheit or Celsius)
+// configured on the panel. Updated is the time of the last reading, and is
+// zero if the thermostat has not reported.
+type ThermostatStatus struct {
+	Indoor       int
+	Outdoor      int
+	CoolSetPoint int
+	HeatSetPoint int
+	Updated      time.Time
 }
 
 type panel struct {
-	conn        Client
-	status      *PanelStatus
-	code        string
-	wait        chan struct{}
-	ready       bool
-	onZone      func(int, ZoneStatus)
-	onPartition func(int, PartitionStatus)
-	onKeypad    func(KeypadStatus)
-}
-
-// NewPanel creates a new Panel interface.
-func NewPanel() Panel {
+	sync.RWMutex
+	conn         Client
+	status       *PanelStatus
+	code         string
+	wait         chan struct{}
+	failed       chan error
+	ready        bool
+	onZone       func(int, ZoneStatus)
+	onZoneState  func(int, ZoneState)
+	onPartition  func(int, PartitionStatus)
+	onPartState  func(int, PartitionState)
+	onKeypad     func(KeypadStatus)
+	onThermostat func(int, ThermostatStatus)
+	onOutput     func(int, int, OutputEvent)
+	onChime      func(int, bool)
+	onError      func(error)
+	onSafety     func(LifeSafetyEvent)
+	onComm       func(CommunicatorEvent)
+	onTrouble    func(bool)
+	notify       chan struct{}
+	err          error
+	errAt        time.Time
+	codeSent     map[CodeKind]time.Time
+	confirm      time.Duration
+	log          Logger
+	clockSync    bool
+	clockDrift   time.Duration
+	clockResync  time.Duration
+	onDisconnect func(error)
+	stop         chan struct{}
+	refreshing   sync.Mutex
+	staged       *PanelStatus
+	replay       []func()
+	emitting     bool
+	settleTime   time.Duration
+	reconcile    time.Duration
+	arming       []armRequest
+}
+
+// NewPanel creates a new Panel interface configured by the supplied options.
+// The options are also applied to the underlying Client.
+func NewPanel(opts ...Option) Panel {
+	cfg := newConfig(opts)
 	status := &PanelStatus{
-		Zone:      make([]ZoneStatus, 64),
-		Partition: make([]PartitionStatus, 8),
+		Zone:             make([]ZoneStatus, cfg.zones),
+		Zones:            make([]ZoneState, cfg.zones),
+		Partition:        make([]PartitionStatus, cfg.partitions),
+		Partitions:       make([]PartitionState, cfg.partitions),
+		ZoneUpdated:      make([]time.Time, cfg.zones),
+		PartitionUpdated: make([]time.Time, cfg.partitions),
+		Thermostat:       make([]ThermostatStatus, 4),
+		Chime:            make([]bool, cfg.partitions),
+		ChimeUpdated:     make([]time.Time, cfg.partitions),
+	}
+	p := &panel{
+		conn:        NewClient(opts...),
+		status:      status,
+		log:         cfg.logger,
+		clockSync:   cfg.clockSync,
+		clockDrift:  cfg.clockDrift,
+		clockResync: cfg.clockResync,
+		notify:      make(chan struct{}),
+		codeSent:    make(map[CodeKind]time.Time),
+		confirm:     cfg.confirm,
+		settleTime:  cfg.settleTime,
+		reconcile:   cfg.reconcile,
+		arming:      make([]armRequest, cfg.partitions),
 	}
-	return &panel{status: status}
+	p.conn.HandleDisconnect(p.handleDisconnect)
+	return p
 }
 
 func (p *panel) Connect(host string, pwd string, code string) error {
-	conn := NewClient()
+	conn := p.conn
 
-	conn.HandleZoneState(p.handleZone)
-	conn.HandlePartitionState(p.handlePartition)
+	conn.HandleZoneEvent(p.handleZoneEvent)
+	conn.HandleBypassedZones(p.handleBypassedZones)
+	conn.HandlePartitionEvent(p.handlePartitionEvent)
 	conn.HandleKeypadState(p.handleKeypad)
+	conn.HandleTimeBroadcast(p.handleTime)
+	conn.HandleTemperature(p.handleTemperature)
+	conn.HandleOutput(p.handleOutput)
+	conn.HandleChime(p.handleChime)
+	conn.HandleError(p.handleError)
+	conn.HandleCodeSent(p.handleCodeSent)
+	conn.HandleLifeSafety(p.handleLifeSafety)
+	conn.HandleCommunicator(p.handleCommunicator)
+	conn.HandleTrouble(p.handleTrouble)
 
-	if err := conn.Connect(host, pwd, code); err != nil {
-		return err
-	}
-	p.conn = conn
+	wait := make(chan struct{})
+	stop := make(chan struct{})
+	failed := make(chan error, 1)
+	p.stopLoops()
+	p.Lock()
 	p.code = code
-	p.wait = make(chan struct{})
+	p.wait = wait
+	p.stop = stop
+	p.failed = failed
+	p.Unlock()
 
-	<-p.wait
+	// The client requests a status report once logged in, which is
+	// collected like one made by Refresh.
+	p.refreshing.Lock()
+	p.beginRefresh()
+	err := p.login(host, pwd, code, wait, failed)
+	if err == nil {
+		// A panel that never goes quiet must not keep Connect waiting.
+		ctx, cancel := context.WithTimeout(context.Background(), p.confirm)
+		if p.settle(ctx) != nil {
+			p.log.Warn("status report did not settle", "timeout", p.confirm)
+		}
+		cancel()
+	}
+	p.endRefresh(err == nil)
+	p.refreshing.Unlock()
+	if err != nil {
+		p.stopLoops()
+		return err
+	}
 
-	t := time.Now()
-	log.Println("setting system time to", t.Format(time.Stamp))
-	if err := p.SetTime(t); err != nil {
-		log.Println("error:", err)
+	if p.clockSync {
+		p.syncClock()
+		if p.clockResync > 0 {
+			go p.resyncClock(stop)
+		}
+	}
+	if err := p.conn.Send(Command{Code: CommandTimeBroadcastControl, Data: "1"}); err != nil {
+		p.log.Warn("could not enable time broadcast", "err", err)
+	}
+	if err := p.conn.Send(Command{Code: CommandTemperatureBroadcastControl, Data: "1"}); err != nil {
+		p.log.Warn("could not enable temperature broadcast", "err", err)
 	}
 
+	p.Lock()
 	p.ready = true
+	p.Unlock()
+
+	if p.reconcile > 0 {
+		go p.reconcileStatus(stop)
+	}
 
 	return nil
 }
 
-func (p *panel) Disconnect() {
-	if p.conn != nil {
+// login connects and waits for the first status from the panel, or for the
+// session to be refused or the login to fail. The connection is closed if the
+// status does not follow within the confirm timeout.
+func (p *panel) login(host string, pwd string, code string, wait chan struct{}, failed chan error) error {
+	if err := p.conn.Connect(host, pwd, code); err != nil {
+		return err
+	}
+	timeout := time.NewTimer(p.confirm)
+	defer timeout.Stop()
+	select {
+	case <-wait:
+	case err := <-failed:
+		return err
+	case <-timeout.C:
+		p.Lock()
+		p.failed = nil
+		p.Unlock()
 		p.conn.Disconnect()
-		p.conn = nil
+		return ErrTimeout
+	}
+	p.Lock()
+	p.failed = nil
+	p.Unlock()
+	select {
+	case err := <-failed:
+		return err
+	default:
+		return nil
 	}
 }
 
-func (p *panel) Status() *PanelStatus {
-	return p.status
+func (p *panel) Disconnect() {
+	p.stopLoops()
+	p.conn.Disconnect()
 }
 
-func (p *panel) handleZone(zone int, status ZoneStatus) {
-	p.status.Zone[zone-1] = status
-	if p.ready && p.onZone != nil {
-		p.onZone(zone, status)
+// stopLoops stops the background tasks started by Connect.
+func (p *panel) stopLoops() {
+	p.Lock()
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
 	}
+	p.Unlock()
 }
 
-func (p *panel) handlePartition(partition int, status PartitionStatus) {
-	p.status.Partition[partition-1] = status
-	if p.ready && p.onPartition != nil {
-		p.onPartition(partition, status)
+func (p *panel) handleDisconnect(err error) {
+	p.stopLoops()
+	p.RLock()
+	failed, onDisconnect := p.failed, p.onDisconnect
+	p.RUnlock()
+	if failed != nil {
+		// Connect is still waiting and returns the error instead.
+		failed <- err
+		return
+	}
+	if onDisconnect != nil {
+		onDisconnect(err)
 	}
 }
 
-func (p *panel) handleKeypad(status KeypadStatus) {
-	p.status.Keypad = status
-	if p.ready && p.onKeypad != nil {
-		p.onKeypad(status)
+func (p *panel) Status() *PanelStatus {
+	p.RLock()
+	defer p.RUnlock()
+	return p.status.clone()
+}
+
+// changed records an update to the panel status and wakes any goroutines
+// waiting in await. It must be called with p locked.
+func (p *panel) changed() {
+	p.status.Revision++
+	p.wake()
+}
+
+// wake wakes any goroutines waiting in await. It must be called with p
+// locked.
+func (p *panel) wake() {
+	close(p.notify)
+	p.notify = make(chan struct{})
+}
+
+// await waits until cond is true of the panel status, evaluating it again
+// after each update, and returns a snapshot of the matching status. It fails
+// early with any error the panel reports after since, unless since is zero.
+// cond is called with p read locked, so it may read other panel state but
+// must not lock p.
+func (p *panel) await(ctx context.Context, since time.Time, cond func(*PanelStatus) bool) (*PanelStatus, error) {
+	for {
+		p.RLock()
+		if cond(p.status) {
+			s := p.status.clone()
+			p.RUnlock()
+			return s, nil
+		}
+		notify, err, failed := p.notify, p.err, !since.IsZero() && p.errAt.After(since)
+		p.RUnlock()
+		if failed {
+			return nil, err
+		}
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
+}
+
+func (p *panel) handleKeypad(status KeypadStatus) {
+	p.Lock()
+	s, staged := p.live()
+	report := !staged || s.Keypad != status
+	s.Keypad = status
+	s.KeypadUpdated = time.Now()
+	onKeypad, wait := p.onKeypad, p.wait
+	p.deliver(staged, func() {
+		if report && onKeypad != nil {
+			onKeypad(status)
+		}
+	})
 	select {
-	case p.wait <- struct{}{}:
+	case wait <- struct{}{}:
 	default:
 	}
 }
 
+func (p *panel) handleTemperature(thermostat int, kind TemperatureKind, degrees int) {
+	if thermostat < 1 || thermostat > len(p.status.Thermostat) {
+		return
+	}
+	p.Lock()
+	status := &p.status.Thermostat[thermostat-1]
+	switch kind {
+	case TemperatureIndoor:
+		status.Indoor = degrees
+	case TemperatureOutdoor:
+		status.Outdoor = degrees
+	case TemperatureCoolSetPoint:
+		status.CoolSetPoint = degrees
+	case TemperatureHeatSetPoint:
+		status.HeatSetPoint = degrees
+	}
+	status.Updated = time.Now()
+	p.changed()
+	ready, onThermostat, s := p.ready, p.onThermostat, *status
+	p.Unlock()
+	if ready && onThermostat != nil {
+		onThermostat(thermostat, s)
+	}
+}
+
+func (p *panel) handleOutput(partition int, output int, event OutputEvent) {
+	p.RLock()
+	ready, onOutput := p.ready, p.onOutput
+	p.RUnlock()
+	if ready && onOutput != nil {
+		onOutput(partition, output, event)
+	}
+}
+
+func (p *panel) handleLifeSafety(event LifeSafetyEvent) {
+	p.RLock()
+	onSafety := p.onSafety
+	p.RUnlock()
+	if onSafety != nil {
+		onSafety(event)
+	}
+	p.Lock()
+	switch event {
+	case LifeSafetyDuress:
+		p.status.Duress = time.Now()
+	case LifeSafetySmokeAlarm, LifeSafetySmokeRestored:
+		p.status.SmokeAlarm = event == LifeSafetySmokeAlarm
+	case LifeSafetyFireTrouble, LifeSafetyFireTroubleRestored:
+		p.status.FireTrouble = event == LifeSafetyFireTrouble
+	}
+	p.changed()
+	p.Unlock()
+}
+
+func (p *panel) handleCommunicator(event CommunicatorEvent) {
+	p.Lock()
+	if event == CommunicatorFTCTrouble {
+		p.status.FTCTrouble = true
+		p.changed()
+	}
+	ready, onComm := p.ready, p.onComm
+	p.Unlock()
+	if ready && onComm != nil {
+		onComm(event)
+	}
+}
+
+func (p *panel) handleTrouble(on bool) {
+	p.Lock()
+	p.status.Trouble = on
+	if !on {
+		p.status.FTCTrouble = false
+	}
+	p.changed()
+	ready, onTrouble := p.ready, p.onTrouble
+	p.Unlock()
+	if ready && onTrouble != nil {
+		onTrouble(on)
+	}
+}
+
+func (p *panel) handleError(err error) {
+	p.Lock()
+	// A malformed frame is not a response to any request in progress.
+	var perr *ProtocolError
+	if !errors.As(err, &perr) {
+		p.err = err
+		p.errAt = time.Now()
+		p.wake()
+	}
+	onError := p.onError
+	p.Unlock()
+	if onError != nil {
+		onError(err)
+	}
+}
+
+func (p *panel) handleChime(partition int, on bool) {
+	if partition < 1 || partition > len(p.status.Chime) {
+		return
+	}
+	now := time.Now()
+	p.Lock()
+	p.status.Chime[partition-1] = on
+	p.status.ChimeUpdated[partition-1] = now
+	var states func()
+	s, staged := p.live()
+	if state := &s.Partitions[partition-1]; state.Chime != on {
+		state.Chime = on
+		state.ChangedAt = now
+		states = p.partitionStates(s, []int{partition})
+	}
+	// The chime is not part of a status report, so it is reported at once,
+	// but the partition state is reported in order with the rest of it.
+	onChime := p.onChime
+	if staged {
+		if states != nil {
+			p.replay = append(p.replay, states)
+		}
+		p.changed()
+		ready := p.ready
+		p.Unlock()
+		if ready && onChime != nil {
+			onChime(partition, on)
+		}
+		return
+	}
+	p.deliver(false, func() {
+		if onChime != nil {
+			onChime(partition, on)
+		}
+		if states != nil {
+			states()
+		}
+	})
+}
+
+// handleTime records the panel clock from a time broadcast and sets it to
+// the host clock if it has drifted too far.
+func (p *panel) handleTime(t time.Time) {
+	// The broadcast only has minute resolution.
+	drift := t.Sub(time.Now().Truncate(time.Minute))
+	p.Lock()
+	p.status.PanelTime = t
+	p.status.ClockDrift = drift
+	p.changed()
+	p.Unlock()
+	if drift < 0 {
+		drift = -drift
+	}
+	if p.clockSync && drift > p.clockDrift {
+		p.log.Warn("panel clock has drifted", "panel", t.Format(time.Stamp), "drift", drift)
+		// The broadcast is handled on the client's listener, so the
+		// command must be sent from another goroutine.
+		go p.syncClock()
+	}
+}
+
+// resyncClock sets the panel clock every resync interval until stop is
+// closed.
+func (p *panel) resyncClock(stop chan struct{}) {
+	t := time.NewTicker(p.clockResync)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			p.syncClock()
+		}
+	}
+}
+
+func (p *panel) syncClock() {
+	t := time.Now()
+	p.log.Info("setting system time", "time", t.Format(time.Stamp))
+	if err := p.SetTime(t); err != nil {
+		p.log.Error("could not set system time", "err", err)
+	}
+}
+
 func (p *panel) SetTime(t time.Time) error {
 	data := t.Format("1504010206")
 	return p.conn.Send(Command{Code: CommandSetTimeAndDate, Data: data})
 }
 
 func (p *panel) Arm(partition int, mode ArmMode) error {
-	if partition < 1 || partition > 8 {
-		return errors.New("invalid partition")
+	return p.arm(partition, mode, "")
+}
+
+func (p *panel) ArmWithCode(partition int, mode ArmMode, code string) error {
+	if !validCode(code) {
+		return ErrInvalidCode
 	}
-	data := strconv.Itoa(partition)
+	return p.arm(partition, mode, code)
+}
+
+// arm arms a partition with code, or with the code passed to Connect if code
+// is empty. Away with a code is sent as 033, which carries the code; the
+// other commands carry none, so code is sent in answer to the code request
+// (900) that follows them. Instant is entered as [*][9] and the code, and
+// night is armed stay with [*][1] sent once the partition is armed.
+func (p *panel) arm(partition int, mode ArmMode, code string) error {
+	if partition < 1 || partition > len(p.status.Partition) {
+		return ErrInvalidPartition
+	}
+	cmd := Command{Data: strconv.Itoa(partition)}
 	switch mode {
-	case ArmAway:
-		p.conn.Send(Command{Code: CommandPartitionArmControlAway, Data: data})
-	case ArmStay:
-		p.conn.Send(Command{Code: CommandPartitionArmControlStay, Data: data})
+	case ArmAway, ArmForce:
+		cmd.Code = CommandPartitionArmControlAway
+		if code != "" {
+			cmd.Code = CommandPartitionArmControlWithCode
+			cmd.Data += code
+		}
+	case ArmStay, ArmNight:
+		cmd.Code = CommandPartitionArmControlStay
 	case ArmNoEntryDelay:
-		p.conn.Send(Command{Code: CommandPartitionArmControlZeroEntry, Data: data})
+		cmd.Code = CommandPartitionArmControlZeroEntry
+	case ArmInstant:
+		// Entered as keys below.
+	default:
+		return ErrInvalidArmMode
+	}
+	p.Lock()
+	if mode == ArmForce && !p.status.Partitions[partition-1].Ready {
+		p.Unlock()
+		return ErrForceArmUnavailable
+	}
+	if mode == ArmInstant && code == "" {
+		code = p.code
+	}
+	// Without a code, the keypad would be left waiting for one.
+	if mode == ArmInstant && !validCode(code) {
+		p.Unlock()
+		return ErrInvalidCode
 	}
+	p.arming[partition-1] = armRequest{mode: mode, expires: time.Now().Add(p.confirm)}
+	p.Unlock()
 
-	return nil
+	var err error
+	switch {
+	case mode == ArmInstant:
+		err = p.sendKeys(partition, "*9"+code)
+	case code == "" || cmd.Code == CommandPartitionArmControlWithCode:
+		err = p.conn.Send(cmd)
+	default:
+		err = p.conn.SendWithCode(cmd, code)
+	}
+	if err != nil {
+		p.Lock()
+		p.arming[partition-1] = armRequest{}
+		p.Unlock()
+	}
+	return err
 }
 
 func (p *panel) Disarm(partition int) error {
-	if partition < 1 || partition > 8 {
-		return errors.New("invalid partition")
+	p.RLock()
+	code := p.code
+	p.RUnlock()
+	return p.disarm(partition, code)
+}
+
+func (p *panel) DisarmWithCode(partition int, code string) error {
+	if !validCode(code) {
+		return ErrInvalidCode
 	}
-	data := fmt.Sprintf("%d%s", partition, p.code)
+	return p.disarm(partition, code)
+}
+
+func (p *panel) disarm(partition int, code string) error {
+	if partition < 1 || partition > len(p.status.Partition) {
+		return ErrInvalidPartition
+	}
+	data := fmt.Sprintf("%d%s", partition, code)
 	return p.conn.Send(Command{Code: CommandPartitionDisarmControl, Data: data})
 }
 
+// SetChime toggles the chime with the *4 keys until the panel reports the
+// requested state. As the panel only reports the chime when it changes, the
+// first toggle may be needed just to learn the current state.
+func (p *panel) SetChime(partition int, on bool) error {
+	if partition < 1 || partition > len(p.status.Chime) {
+		return ErrInvalidPartition
+	}
+	i := partition - 1
+	for attempt := 0; attempt < 2; attempt++ {
+		p.RLock()
+		known, current := !p.status.ChimeUpdated[i].IsZero(), p.status.Chime[i]
+		p.RUnlock()
+		if known && current == on {
+			return nil
+		}
+		sent := time.Now()
+		data := fmt.Sprintf("%d*4", partition)
+		if err := p.conn.Send(Command{Code: CommandKeystroke, Data: data}); err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), p.confirm)
+		s, err := p.await(ctx, sent, func(s *PanelStatus) bool {
+			return s.ChimeUpdated[i].After(sent)
+		})
+		cancel()
+		if err != nil {
+			return ErrNotConfirmed
+		}
+		if s.Chime[i] == on {
+			return nil
+		}
+	}
+	return ErrNotConfirmed
+}
+
+func (p *panel) ActivateOutput(partition int, output int) error {
+	if partition < 1 || partition > len(p.status.Partition) {
+		return ErrInvalidPartition
+	}
+	if output < 1 || output > 4 {
+		return ErrInvalidOutput
+	}
+	data := fmt.Sprintf("%d%d", partition, output)
+	return p.conn.Send(Command{Code: CommandOutputControl, Data: data})
+}
+
 func (p *panel) OnZoneEvent(f func(int, ZoneStatus)) {
+	p.Lock()
 	p.onZone = f
+	p.Unlock()
+}
+
+func (p *panel) OnPartitionStateEvent(f func(int, PartitionState)) {
+	p.Lock()
+	p.onPartState = f
+	p.Unlock()
+}
+
+func (p *panel) OnZoneStateEvent(f func(int, ZoneState)) {
+	p.Lock()
+	p.onZoneState = f
+	p.Unlock()
 }
 
 func (p *panel) OnPartitionEvent(f func(int, PartitionStatus)) {
+	p.Lock()
 	p.onPartition = f
+	p.Unlock()
 }
 
 func (p *panel) OnKeypadEvent(f func(KeypadStatus)) {
+	p.Lock()
 	p.onKeypad = f
+	p.Unlock()
+}
+
+func (p *panel) OnOutputEvent(f func(int, int, OutputEvent)) {
+	p.Lock()
+	p.onOutput = f
+	p.Unlock()
+}
+
+func (p *panel) OnLifeSafetyEvent(f func(LifeSafetyEvent)) {
+	p.Lock()
+	p.onSafety = f
+	p.Unlock()
+}
+
+func (p *panel) OnCommunicatorEvent(f func(CommunicatorEvent)) {
+	p.Lock()
+	p.onComm = f
+	p.Unlock()
+}
+
+func (p *panel) OnTroubleEvent(f func(bool)) {
+	p.Lock()
+	p.onTrouble = f
+	p.Unlock()
+}
+
+func (p *panel) OnError(f func(error)) {
+	p.Lock()
+	p.onError = f
+	p.Unlock()
+}
+
+func (p *panel) OnChimeEvent(f func(int, bool)) {
+	p.Lock()
+	p.onChime = f
+	p.Unlock()
+}
+
+func (p *panel) OnThermostatEvent(f func(int, ThermostatStatus)) {
+	p.Lock()
+	p.onThermostat = f
+	p.Unlock()
 }
 
 func (p *panel) Poll() error {
-	return p.conn.Status()
+	return p.conn.Send(Command{Code: CommandPoll})
+}
+
+func (p *panel) Health() Health {
+	return p.conn.Health()
+}
+
+func (p *panel) OnDisconnect(f func(error)) {
+	p.Lock()
+	p.onDisconnect = f
+	p.Unlock()
+}
+
+func (p *panel) Metrics() Metrics {
+	return p.conn.Metrics()
 }
@@ -0,0 +1,1071 @@
+package etpi
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeEnvisalink plays the Envisalink side of a MockConn. It acknowledges
+// every command it receives and completes the login and status report
+// exchanges made by Panel.Connect, rejecting the login if password is set
+// and does not match. A status report is answered with the keypad state
+// followed by report.
+type fakeEnvisalink struct {
+	conn *MockConn
+	sync.Mutex
+	received []Command
+	chime    map[string]bool
+	password string
+	report   []Command
+	reject   map[string]string
+}
+
+func newFakeEnvisalink() *fakeEnvisalink {
+	f := &fakeEnvisalink{conn: NewMockConn(), chime: make(map[string]bool)}
+	go f.serve()
+	return f
+}
+
+func (f *fakeEnvisalink) transport(string) (io.ReadWriteCloser, error) {
+	go f.send(Command{Code: CommandLoginStatus, Data: "3"})
+	return f.conn.Client, nil
+}
+
+func (f *fakeEnvisalink) serve() {
+	r := bufio.NewReader(f.conn.Server)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		cmd, err := NewCommandFromBytes(line)
+		if err != nil {
+			continue
+		}
+		f.Lock()
+		f.received = append(f.received, *cmd)
+		code, rejected := f.reject[cmd.Code]
+		f.Unlock()
+		if rejected {
+			f.send(Command{Code: CommandSystemError, Data: code})
+			continue
+		}
+		f.send(Command{Code: CommandAck, Data: cmd.Code})
+		switch cmd.Code {
+		case CommandLogin:
+			f.Lock()
+			accepted := f.password == "" || f.password == cmd.Data
+			f.Unlock()
+			if !accepted {
+				f.send(Command{Code: CommandLoginStatus, Data: "0"})
+				f.conn.Server.Close()
+				return
+			}
+			f.send(Command{Code: CommandLoginStatus, Data: "1"})
+		case CommandStatusReport:
+			f.send(Command{Code: CommandKeypadLed, Data: "81"})
+			f.Lock()
+			report := f.report
+			f.Unlock()
+			for _, cmd := range report {
+				f.send(cmd)
+			}
+		case CommandUserCodeProgramming:
+			f.send(Command{Code: CommandMasterCodeRequired})
+		case CommandKeystroke:
+			if cmd.Data[1:] == "#" {
+				f.send(Command{Code: CommandPartitionReady, Data: cmd.Data[:1]})
+			}
+			if cmd.Data[1:] == "*4" {
+				partition := cmd.Data[:1]
+				f.Lock()
+				f.chime[partition] = !f.chime[partition]
+				on := f.chime[partition]
+				f.Unlock()
+				if on {
+					f.send(Command{Code: CommandPartitionChimeEnabled, Data: partition})
+				} else {
+					f.send(Command{Code: CommandPartitionChimeDisabled, Data: partition})
+				}
+			}
+		}
+	}
+}
+
+func (f *fakeEnvisalink) send(cmd Command) {
+	f.Lock()
+	defer f.Unlock()
+	cmd.WriteTo(f.conn.Server)
+}
+
+// waitFor waits until n commands with code have been received.
+func (f *fakeEnvisalink) waitFor(t *testing.T, code string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if f.count(code) >= n {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d %s commands", n, code)
+}
+
+// count returns the number of commands received with code.
+func (f *fakeEnvisalink) count(code string) int {
+	f.Lock()
+	defer f.Unlock()
+	n := 0
+	for _, cmd := range f.received {
+		if cmd.Code == code {
+			n++
+		}
+	}
+	return n
+}
+
+// last returns the last command received with code.
+func (f *fakeEnvisalink) last(code string) Command {
+	f.Lock()
+	defer f.Unlock()
+	for i := len(f.received) - 1; i >= 0; i-- {
+		if f.received[i].Code == code {
+			return f.received[i]
+		}
+	}
+	return Command{}
+}
+
+// waitStatus waits until cond is true of the panel status.
+func waitStatus(t *testing.T, p Panel, cond func(*PanelStatus) bool) *PanelStatus {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if s := p.Status(); cond(s) {
+			return s
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for panel status")
+	return nil
+}
+
+func connectPanel(t *testing.T, opts ...Option) (Panel, *fakeEnvisalink) {
+	f := newFakeEnvisalink()
+	opts = append([]Option{
+		WithTransport(f.transport),
+		WithAckTimeout(20 * time.Millisecond),
+		WithClockSync(false),
+		WithSettleTime(20 * time.Millisecond),
+		WithLogger(NewStdLogger(nil, LevelError)),
+	}, opts...)
+	p := NewPanel(opts...)
+	if err := p.Connect("envisalink", "user", "1234"); err != nil {
+		t.Fatal(err)
+	}
+	return p, f
+}
+
+func TestPanelStatusSnapshot(t *testing.T) {
+	p, f := connectPanel(t)
+	defer p.Disconnect()
+
+	events := make(chan int)
+	p.OnZoneEvent(func(zone int, status ZoneStatus) {
+		events <- zone
+	})
+
+	before := p.Status()
+	if !before.Keypad.Ready || before.KeypadUpdated.IsZero() {
+		t.Errorf("expected keypad status from connect, got %+v", before.Keypad)
+	}
+
+	var w sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		w.Add(1)
+		go func() {
+			defer w.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				s := p.Status()
+				_ = s.Zone[0]
+				s.Zone[1] = ZoneStatusAlarm
+			}
+		}()
+	}
+
+	go f.send(Command{Code: CommandZoneOpen, Data: "001"})
+	<-events
+	close(done)
+	w.Wait()
+
+	after := p.Status()
+	if after.Zone[0] != ZoneStatusOpen || after.ZoneUpdated[0].IsZero() {
+		t.Errorf("expected zone 1 open, got %v at %v", after.Zone[0], after.ZoneUpdated[0])
+	}
+	if after.Zone[1] != UnknownStatus {
+		t.Error("snapshot shares state with panel")
+	}
+	if before.Zone[0] != UnknownStatus {
+		t.Error("earlier snapshot was modified")
+	}
+	if after.Revision <= before.Revision {
+		t.Errorf("expected revision to increase, got %d then %d", before.Revision, after.Revision)
+	}
+}
+
+func TestPanelLimits(t *testing.T) {
+	s := NewPanel(WithZones(-1), WithPartitions(9)).Status()
+	if len(s.Zones) != 1 || len(s.Partitions) != 8 {
+		t.Errorf("expected 1 zone and 8 partitions, got %d and %d", len(s.Zones), len(s.Partitions))
+	}
+	s = NewPanel(WithZones(100), WithPartitions(0)).Status()
+	if len(s.Zones) != 64 || len(s.Partitions) != 1 {
+		t.Errorf("expected 64 zones and 1 partition, got %d and %d", len(s.Zones), len(s.Partitions))
+	}
+}
+
+func TestPanelClockDrift(t *testing.T) {
+	p, f := connectPanel(t, WithClockSync(true), WithClockResync(0))
+	defer p.Disconnect()
+	f.waitFor(t, CommandSetTimeAndDate, 1)
+	f.waitFor(t, CommandTimeBroadcastControl, 1)
+
+	panelTime := time.Now().Add(10 * time.Minute).Truncate(time.Minute)
+	f.send(Command{Code: CommandTimeBroadcast, Data: panelTime.Format("1504010206")})
+	f.waitFor(t, CommandSetTimeAndDate, 2)
+
+	s := p.Status()
+	if !s.PanelTime.Equal(panelTime) {
+		t.Errorf("expected panel time %v, got %v", panelTime, s.PanelTime)
+	}
+	if s.ClockDrift < 9*time.Minute || s.ClockDrift > 11*time.Minute {
+		t.Errorf("expected 10 minute drift, got %v", s.ClockDrift)
+	}
+}
+
+func TestPanelThermostat(t *testing.T) {
+	p, f := connectPanel(t)
+	defer p.Disconnect()
+	f.waitFor(t, CommandTemperatureBroadcastControl, 1)
+
+	events := make(chan ThermostatStatus, 4)
+	p.OnThermostatEvent(func(thermostat int, status ThermostatStatus) {
+		if thermostat == 2 {
+			events <- status
+		}
+	})
+	f.send(Command{Code: CommandIndoorTemperature, Data: "2072"})
+	f.send(Command{Code: CommandOutdoorTemperature, Data: "2250"})
+	f.send(Command{Code: CommandThermostatSetPoints, Data: "2078068"})
+	var last ThermostatStatus
+	for i := 0; i < 4; i++ {
+		last = <-events
+	}
+	want := ThermostatStatus{Indoor: 72, Outdoor: -6, CoolSetPoint: 78, HeatSetPoint: 68}
+	want.Updated = last.Updated
+	if last != want {
+		t.Errorf("expected %+v, got %+v", want, last)
+	}
+	if s := p.Status(); s.Thermostat[1] != last || !s.Thermostat[0].Updated.IsZero() {
+		t.Errorf("unexpected thermostat status %+v", s.Thermostat)
+	}
+}
+
+func TestPanelActivateOutput(t *testing.T) {
+	p, f := connectPanel(t, WithPartitions(2))
+	defer p.Disconnect()
+
+	if err := p.ActivateOutput(3, 1); err != ErrInvalidPartition {
+		t.Errorf("expected ErrInvalidPartition, got %v", err)
+	}
+	if err := p.ActivateOutput(1, 5); err != ErrInvalidOutput {
+		t.Errorf("expected ErrInvalidOutput, got %v", err)
+	}
+
+	events := make(chan [2]int, 1)
+	p.OnOutputEvent(func(partition int, output int, event OutputEvent) {
+		if event == OutputPressed {
+			events <- [2]int{partition, output}
+		}
+	})
+	if err := p.ActivateOutput(2, 3); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := f.last(CommandOutputControl); cmd.Data != "23" {
+		t.Errorf("expected output 3 of partition 2, got %v", cmd)
+	}
+	f.send(Command{Code: CommandOutputPressed, Data: "23"})
+	if e := <-events; e != [2]int{2, 3} {
+		t.Errorf("unexpected output event %v", e)
+	}
+}
+
+func TestPanelSetChime(t *testing.T) {
+	p, f := connectPanel(t, WithPartitions(2))
+	defer p.Disconnect()
+	f.Lock()
+	f.chime["2"] = true
+	f.Unlock()
+
+	// The chime state is unknown until the first toggle.
+	if err := p.SetChime(1, true); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.count(CommandKeystroke); n != 1 {
+		t.Errorf("expected 1 toggle, got %d", n)
+	}
+	if err := p.SetChime(1, true); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.count(CommandKeystroke); n != 1 {
+		t.Errorf("expected no toggle when already enabled, got %d", n-1)
+	}
+	if err := p.SetChime(2, true); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.count(CommandKeystroke); n != 3 {
+		t.Errorf("expected 2 toggles from an unknown state, got %d", n-1)
+	}
+	s := p.Status()
+	if !s.Chime[0] || !s.Chime[1] {
+		t.Errorf("expected chime enabled, got %v", s.Chime)
+	}
+	if err := p.SetChime(3, true); err != ErrInvalidPartition {
+		t.Errorf("expected ErrInvalidPartition, got %v", err)
+	}
+}
+
+func TestPanelSetUserCode(t *testing.T) {
+	p, f := connectPanel(t, WithMasterCode(StaticSecret("5555")))
+	defer p.Disconnect()
+
+	if err := p.SetUserCode(96, "1234"); err != ErrInvalidSlot {
+		t.Errorf("expected ErrInvalidSlot, got %v", err)
+	}
+	if err := p.SetUserCode(5, "12345"); err != ErrInvalidCode {
+		t.Errorf("expected ErrInvalidCode, got %v", err)
+	}
+	if err := p.DeleteUserCode(40); err != ErrInvalidSlot {
+		t.Errorf("expected master code to be protected, got %v", err)
+	}
+
+	if err := p.SetUserCode(5, "246810"); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := f.last(CommandCode); cmd.Data != "5555" {
+		t.Errorf("expected master code to be sent, got %v", cmd)
+	}
+	var keys string
+	f.Lock()
+	for _, cmd := range f.received {
+		if cmd.Code == CommandKeystroke {
+			keys += cmd.Data[1:]
+		}
+	}
+	f.Unlock()
+	if keys != "05246810#" {
+		t.Errorf("unexpected keys %q", keys)
+	}
+}
+
+func TestPanelSetUserCodeWithoutMasterCode(t *testing.T) {
+	p, f := connectPanel(t)
+	defer p.Disconnect()
+
+	err := p.DeleteUserCode(5)
+	if e, ok := err.(*CodeRequiredError); !ok || e.Kind != MasterCode {
+		t.Errorf("expected master CodeRequiredError, got %v", err)
+	}
+	f.waitFor(t, CommandKeystroke, 1)
+	if cmd := f.last(CommandKeystroke); cmd.Data != "1#" {
+		t.Errorf("expected programming to be exited, got %v", cmd)
+	}
+}
+
+func TestPanelArmWithCode(t *testing.T) {
+	p, f := connectPanel(t)
+	defer p.Disconnect()
+
+	if err := p.ArmWithCode(1, ArmAway, "12a4"); err != ErrInvalidCode {
+		t.Errorf("expected ErrInvalidCode, got %v", err)
+	}
+	if err := p.DisarmWithCode(1, "12345"); err != ErrInvalidCode {
+		t.Errorf("expected ErrInvalidCode, got %v", err)
+	}
+	if err := p.Arm(1, ArmMode(9)); err != ErrInvalidArmMode {
+		t.Errorf("expected ErrInvalidArmMode, got %v", err)
+	}
+
+	if err := p.ArmWithCode(1, ArmAway, "5678"); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := f.last(CommandPartitionArmControlWithCode); cmd.Data != "15678" {
+		t.Errorf("expected away with code, got %v", cmd)
+	}
+	if err := p.DisarmWithCode(2, "246810"); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := f.last(CommandPartitionDisarmControl); cmd.Data != "2246810" {
+		t.Errorf("expected disarm with code, got %v", cmd)
+	}
+
+	// The code request following a command is answered with its code, and
+	// later ones with the session code.
+	request := func(n int, want string) {
+		t.Helper()
+		f.send(Command{Code: CommandCodeRequired, Data: "1"})
+		f.waitFor(t, CommandCode, n)
+		if cmd := f.last(CommandCode); cmd.Data != want {
+			t.Errorf("expected code %s to be sent, got %v", want, cmd)
+		}
+	}
+	if err := p.ArmWithCode(1, ArmStay, "5678"); err != nil {
+		t.Fatal(err)
+	}
+	request(1, "5678")
+	request(2, "1234")
+
+	// Nor is it used for a request following a later command, a rejected
+	// command or a 033, which carries the code itself.
+	if err := p.ArmWithCode(1, ArmStay, "5678"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Disarm(1); err != nil {
+		t.Fatal(err)
+	}
+	request(3, "1234")
+	f.Lock()
+	f.reject = map[string]string{CommandPartitionArmControlStay: "024"}
+	f.Unlock()
+	if err := p.ArmWithCode(1, ArmStay, "5678"); err == nil {
+		t.Fatal("expected rejected arm to fail")
+	}
+	request(4, "1234")
+	if err := p.ArmWithCode(1, ArmAway, "5678"); err != nil {
+		t.Fatal(err)
+	}
+	request(5, "1234")
+}
+
+func TestPanelArmModes(t *testing.T) {
+	p, f := connectPanel(t)
+	defer p.Disconnect()
+
+	errs := make(chan error, 1)
+	p.OnError(func(err error) { errs <- err })
+	states := make(chan PartitionState, 8)
+	p.OnPartitionStateEvent(func(partition int, state PartitionState) {
+		if partition == 1 {
+			states <- state
+		}
+	})
+
+	if err := p.Arm(1, ArmMax); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := f.last(CommandPartitionArmControlZeroEntry); cmd.Data != "1" {
+		t.Errorf("expected max to be armed with no entry delay, got %v", cmd)
+	}
+	if err := p.Arm(1, ArmInstant); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := f.last(CommandKeystroke); cmd.Data != "1*91234" {
+		t.Errorf("expected instant to be entered as keys, got %v", cmd)
+	}
+	if err := p.Arm(1, ArmForce); err != ErrForceArmUnavailable {
+		t.Errorf("expected ErrForceArmUnavailable, got %v", err)
+	}
+	// Instant arming needs a code to enter at the keypad.
+	pp := p.(*panel)
+	pp.Lock()
+	pp.code = ""
+	pp.Unlock()
+	if err := p.Arm(1, ArmInstant); err != ErrInvalidCode {
+		t.Errorf("expected ErrInvalidCode, got %v", err)
+	}
+	if n := f.count(CommandKeystroke); n != 1 {
+		t.Errorf("expected no keys without a code, got %d keystrokes", n)
+	}
+	pp.Lock()
+	pp.code = "1234"
+	pp.Unlock()
+
+	// Night is armed stay, then the night zones with [*][1].
+	if err := p.Arm(1, ArmNight); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := f.last(CommandPartitionArmControlStay); cmd.Data != "1" {
+		t.Errorf("expected night to be armed stay, got %v", cmd)
+	}
+	f.send(Command{Code: CommandPartitionArmed, Data: "11"})
+	if s := <-states; s.ArmMode != ArmNight {
+		t.Errorf("expected armed night, got %v", s.ArmMode)
+	}
+	f.waitFor(t, CommandKeystroke, 2)
+	if cmd := f.last(CommandKeystroke); cmd.Data != "1*1" {
+		t.Errorf("expected night zones to be armed, got %v", cmd)
+	}
+	f.send(Command{Code: CommandPartitionDisarmed, Data: "1"})
+	<-states
+
+	f.send(Command{Code: CommandPartitionReadyForceArm, Data: "1"})
+	<-states
+	if err := p.Arm(1, ArmForce); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := f.last(CommandPartitionArmControlAway); cmd.Data != "1" {
+		t.Errorf("expected force arm to be armed away, got %v", cmd)
+	}
+	f.send(Command{Code: CommandPartitionArmed, Data: "11"})
+	select {
+	case err := <-errs:
+		e, ok := err.(*ArmModeError)
+		if !ok || e.Requested != ArmForce || e.Armed != ArmStay {
+			t.Errorf("expected ArmModeError, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected error for arm mode mismatch")
+	}
+	pp.RLock()
+	if pp.err != nil {
+		t.Errorf("expected arm mode mismatch not to fail requests in progress, got %v", pp.err)
+	}
+	pp.RUnlock()
+	if s := <-states; s.ArmMode != ArmStay {
+		t.Errorf("expected armed stay, got %v", s.ArmMode)
+	}
+}
+
+func TestPanelArmRequestCleared(t *testing.T) {
+	p, f := connectPanel(t, WithConfirmTimeout(200*time.Millisecond))
+	defer p.Disconnect()
+
+	errs := make(chan error, 4)
+	p.OnError(func(err error) { errs <- err })
+	// armedStay reports the partition armed stay at a keypad, and checks
+	// that it is not taken for a night or force arm requested before.
+	armedStay := func(reason string) {
+		t.Helper()
+		f.send(Command{Code: CommandPartitionArmed, Data: "11"})
+		waitStatus(t, p, func(s *PanelStatus) bool { return s.Partitions[0].ArmMode != 0 })
+		time.Sleep(50 * time.Millisecond)
+		if mode := p.Status().Partitions[0].ArmMode; mode != ArmStay {
+			t.Errorf("%s: expected armed stay, got %v", reason, mode)
+		}
+		if n := f.count(CommandKeystroke); n != 0 {
+			t.Errorf("%s: expected no night zone keys, got %d keystrokes", reason, n)
+		}
+		select {
+		case err := <-errs:
+			t.Errorf("%s: unexpected error %v", reason, err)
+		default:
+		}
+		f.send(Command{Code: CommandPartitionDisarmed, Data: "1"})
+		waitStatus(t, p, func(s *PanelStatus) bool { return s.Partitions[0].ArmMode == 0 })
+	}
+
+	f.Lock()
+	f.reject = map[string]string{CommandPartitionArmControlAway: "024", CommandPartitionArmControlStay: "024"}
+	f.Unlock()
+	if err := p.Arm(1, ArmNight); err != ErrAPISystemNotReadytoArm {
+		t.Errorf("expected ErrAPISystemNotReadytoArm, got %v", err)
+	}
+	armedStay("rejected night arm")
+	f.send(Command{Code: CommandPartitionReadyForceArm, Data: "1"})
+	waitStatus(t, p, func(s *PanelStatus) bool { return s.Partitions[0].ForceArmReady })
+	if err := p.Arm(1, ArmForce); err != ErrAPISystemNotReadytoArm {
+		t.Errorf("expected ErrAPISystemNotReadytoArm, got %v", err)
+	}
+	armedStay("rejected force arm")
+	f.Lock()
+	f.reject = nil
+	f.Unlock()
+
+	// An exit delay ending in an alarm ends the request.
+	if err := p.Arm(1, ArmNight); err != nil {
+		t.Fatal(err)
+	}
+	f.send(Command{Code: CommandPartitionExitDelay, Data: "1"})
+	f.send(Command{Code: CommandPartitionAlarm, Data: "1"})
+	waitStatus(t, p, func(s *PanelStatus) bool { return s.Partitions[0].InAlarm })
+	armedStay("exit delay ended in alarm")
+
+	// A request not followed by the exit delay expires.
+	if err := p.Arm(1, ArmNight); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	armedStay("expired night arm")
+
+	// The exit delay keeps it pending beyond the confirm timeout.
+	if err := p.Arm(1, ArmNight); err != nil {
+		t.Fatal(err)
+	}
+	f.send(Command{Code: CommandPartitionExitDelay, Data: "1"})
+	waitStatus(t, p, func(s *PanelStatus) bool { return s.Partitions[0].ExitDelay })
+	time.Sleep(300 * time.Millisecond)
+	f.send(Command{Code: CommandPartitionArmed, Data: "11"})
+	waitStatus(t, p, func(s *PanelStatus) bool { return s.Partitions[0].ArmMode == ArmNight })
+}
+
+func TestPanelLifeSafety(t *testing.T) {
+	p, f := connectPanel(t)
+	defer p.Disconnect()
+
+	events := make(chan LifeSafetyEvent, 3)
+	p.OnLifeSafetyEvent(func(event LifeSafetyEvent) {
+		events <- event
+	})
+	f.send(Command{Code: CommandDuressAlarm, Data: "0000"})
+	f.send(Command{Code: CommandSmokeAuxAlarm})
+	f.send(Command{Code: CommandFireTroubleAlarm})
+	for _, want := range []LifeSafetyEvent{LifeSafetyDuress, LifeSafetySmokeAlarm, LifeSafetyFireTrouble} {
+		if got := <-events; got != want {
+			t.Errorf("expected %v, got %v", want, got)
+		}
+	}
+	f.send(Command{Code: CommandSmokeAuxAlarmRestore})
+	<-events
+	// The callback is made before the status is updated.
+	s := waitStatus(t, p, func(s *PanelStatus) bool { return !s.SmokeAlarm })
+	if s.Duress.IsZero() || !s.FireTrouble {
+		t.Errorf("unexpected life safety status %v %v", s.Duress, s.FireTrouble)
+	}
+}
+
+func TestPanelCommunicator(t *testing.T) {
+	p, f := connectPanel(t)
+	defer p.Disconnect()
+
+	events := make(chan CommunicatorEvent, 2)
+	p.OnCommunicatorEvent(func(event CommunicatorEvent) {
+		events <- event
+	})
+	f.send(Command{Code: CommandRingDetected})
+	f.send(Command{Code: CommandTroubleOn, Data: "1"})
+	f.send(Command{Code: CommandFTCTrouble})
+	for _, want := range []CommunicatorEvent{CommunicatorRingDetected, CommunicatorFTCTrouble} {
+		if got := <-events; got != want {
+			t.Errorf("expected %v, got %v", want, got)
+		}
+	}
+	if s := p.Status(); !s.Trouble || !s.FTCTrouble {
+		t.Errorf("expected trouble, got %v %v", s.Trouble, s.FTCTrouble)
+	}
+	trouble := make(chan bool, 1)
+	p.OnTroubleEvent(func(on bool) {
+		trouble <- on
+	})
+	f.send(Command{Code: CommandTroubleOff, Data: "1"})
+	if on := <-trouble; on {
+		t.Error("expected trouble to clear")
+	}
+	if s := p.Status(); s.Trouble || s.FTCTrouble {
+		t.Errorf("expected no trouble, got %v %v", s.Trouble, s.FTCTrouble)
+	}
+}
+
+func TestPanelConnectLoginFailed(t *testing.T) {
+	f := newFakeEnvisalink()
+	f.Lock()
+	f.password = "secret"
+	f.Unlock()
+	p := NewPanel(WithTransport(f.transport), WithClockSync(false), WithLogger(NewStdLogger(nil, LevelError+1)))
+	disconnected := false
+	p.OnDisconnect(func(error) { disconnected = true })
+	if err := p.Connect("envisalink", "user", "1234"); err != ErrBadPassword {
+		t.Errorf("expected ErrBadPassword, got %v", err)
+	}
+	if disconnected {
+		t.Error("expected no disconnect callback for a failed Connect")
+	}
+}
+
+func TestPanelConnectSessionInUse(t *testing.T) {
+	conn := NewMockConn()
+	conn.Server.Close()
+	p := NewPanel(WithTransport(func(string) (io.ReadWriteCloser, error) {
+		return conn.Client, nil
+	}), WithLogger(NewStdLogger(nil, LevelError+1)))
+	if err := p.Connect("envisalink", "user", "1234"); err != ErrSessionInUse {
+		t.Errorf("expected ErrSessionInUse, got %v", err)
+	}
+}
+
+func TestPanelRefresh(t *testing.T) {
+	f := newFakeEnvisalink()
+	f.report = []Command{
+		{Code: CommandZoneOpen, Data: "003"},
+		{Code: CommandPartitionReady, Data: "1"},
+	}
+	p := NewPanel(WithTransport(f.transport), WithAckTimeout(20*time.Millisecond), WithClockSync(false),
+		WithSettleTime(50*time.Millisecond), WithLogger(NewStdLogger(nil, LevelError)))
+	if err := p.Connect("envisalink", "user", "1234"); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Disconnect()
+
+	// The whole report is in the status as soon as Connect returns.
+	s := p.Status()
+	if s.Zone[2] != ZoneStatusOpen || s.Partition[0] != PartitionStatusReady {
+		t.Errorf("expected status report after connect, got %v %v", s.Zone[:3], s.Partition[:1])
+	}
+
+	events := make(chan int, 8)
+	p.OnZoneEvent(func(zone int, status ZoneStatus) {
+		events <- zone
+	})
+	states := make(chan bool, 8)
+	p.OnZoneStateEvent(func(zone int, state ZoneState) {
+		if zone == 5 {
+			states <- state.Open
+		}
+	})
+	// Zone 5 opens and closes while the report is collected.
+	f.Lock()
+	f.report = []Command{
+		{Code: CommandZoneRestored, Data: "003"},
+		{Code: CommandZoneOpen, Data: "004"},
+		{Code: CommandZoneOpen, Data: "005"},
+		{Code: CommandZoneRestored, Data: "005"},
+		{Code: CommandPartitionReady, Data: "1"},
+	}
+	f.Unlock()
+	if err := p.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s = p.Status()
+	if s.Zone[2] != ZoneStatusRestored || s.Zone[3] != ZoneStatusOpen {
+		t.Errorf("expected refreshed zones, got %v", s.Zone[:4])
+	}
+	// Only the zones that changed are reported, in order.
+	close(events)
+	var zones []int
+	for zone := range events {
+		zones = append(zones, zone)
+	}
+	if !reflect.DeepEqual(zones, []int{3, 4, 5, 5}) {
+		t.Errorf("expected events for zones 3, 4 and 5, got %v", zones)
+	}
+	close(states)
+	var open []bool
+	for state := range states {
+		open = append(open, state)
+	}
+	if !reflect.DeepEqual(open, []bool{true, false}) {
+		t.Errorf("expected zone 5 to open and close, got %v", open)
+	}
+}
+
+func TestPanelRefreshOrder(t *testing.T) {
+	p, f := connectPanel(t)
+	defer p.Disconnect()
+
+	var mu sync.Mutex
+	var statuses []ZoneStatus
+	var inside, overlapped int32
+	p.OnZoneEvent(func(zone int, status ZoneStatus) {
+		if atomic.AddInt32(&inside, 1) > 1 {
+			atomic.StoreInt32(&overlapped, 1)
+		}
+		defer atomic.AddInt32(&inside, -1)
+		mu.Lock()
+		statuses = append(statuses, status)
+		mu.Unlock()
+		// Zone 7 closes while its opening, received during the refresh,
+		// is still being emitted.
+		if status == ZoneStatusOpen {
+			f.send(Command{Code: CommandZoneRestored, Data: "007"})
+			time.Sleep(50 * time.Millisecond)
+		}
+	})
+	f.Lock()
+	f.report = []Command{{Code: CommandZoneOpen, Data: "007"}}
+	f.Unlock()
+	if err := p.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, p, func(s *PanelStatus) bool { return s.Zone[6] == ZoneStatusRestored })
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(statuses, []ZoneStatus{ZoneStatusOpen, ZoneStatusRestored}) {
+		t.Errorf("expected zone 7 to open then close, got %v", statuses)
+	}
+	if atomic.LoadInt32(&overlapped) != 0 {
+		t.Error("expected events to be emitted one at a time")
+	}
+}
+
+func TestPanelConnectUnsettled(t *testing.T) {
+	// With a settle time this long, the panel is never quiet for long
+	// enough.
+	f := newFakeEnvisalink()
+	f.report = []Command{{Code: CommandZoneOpen, Data: "003"}}
+	p := NewPanel(WithTransport(f.transport), WithAckTimeout(20*time.Millisecond), WithClockSync(false),
+		WithSettleTime(time.Hour), WithConfirmTimeout(100*time.Millisecond), WithLogger(NewStdLogger(nil, LevelError)))
+	start := time.Now()
+	if err := p.Connect("envisalink", "user", "1234"); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Disconnect()
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("expected Connect not to wait for the report to settle, took %v", d)
+	}
+	if !p.Status().Zones[2].Open {
+		t.Error("expected status report after connect")
+	}
+}
+
+func TestPanelConnectNoStatus(t *testing.T) {
+	// The status report is refused, so no keypad status follows the login.
+	f := newFakeEnvisalink()
+	f.reject = map[string]string{CommandStatusReport: "022"}
+	p := NewPanel(WithTransport(f.transport), WithAckTimeout(20*time.Millisecond), WithClockSync(false),
+		WithConfirmTimeout(100*time.Millisecond), WithLogger(NewStdLogger(nil, LevelError)))
+	done := make(chan error, 1)
+	go func() { done <- p.Connect("envisalink", "user", "1234") }()
+	select {
+	case err := <-done:
+		if err != ErrTimeout {
+			t.Errorf("expected ErrTimeout, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Connect did not return")
+	}
+}
+
+func TestPanelReconcile(t *testing.T) {
+	p, f := connectPanel(t, WithReconcile(50*time.Millisecond))
+	defer p.Disconnect()
+
+	events := make(chan int, 1)
+	p.OnZoneEvent(func(zone int, status ZoneStatus) {
+		events <- zone
+	})
+	f.Lock()
+	f.report = []Command{{Code: CommandZoneOpen, Data: "010"}}
+	f.Unlock()
+	select {
+	case zone := <-events:
+		if zone != 10 {
+			t.Errorf("expected corrective event for zone 10, got %d", zone)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected corrective event from reconciliation")
+	}
+}
+
+func TestPanelZoneState(t *testing.T) {
+	p, f := connectPanel(t)
+	defer p.Disconnect()
+
+	legacy := make(chan ZoneStatus, 8)
+	p.OnZoneEvent(func(zone int, status ZoneStatus) {
+		legacy <- status
+	})
+	states := make(chan ZoneState, 8)
+	p.OnZoneStateEvent(func(zone int, state ZoneState) {
+		if zone == 5 {
+			states <- state
+		}
+	})
+	f.send(Command{Code: CommandZoneOpen, Data: "005"})
+	f.send(Command{Code: CommandZoneTamper, Data: "2005"})
+	<-states
+	s := <-states
+	if !s.Open || !s.Tampered || s.Partition != 2 || s.LastChanged.IsZero() {
+		t.Errorf("expected zone open and tampered on partition 2, got %+v", s)
+	}
+	if status := <-legacy; status != ZoneStatusOpen {
+		t.Errorf("expected legacy OPEN event, got %v", status)
+	}
+	if status := <-legacy; status != ZoneStatusTamper {
+		t.Errorf("expected legacy TAMPER event, got %v", status)
+	}
+
+	f.send(Command{Code: CommandZoneAlarm, Data: "2005"})
+	<-states
+	alarmed := p.Status().ZoneUpdated[4]
+	f.send(Command{Code: CommandZoneAlarmRestore, Data: "2005"})
+	if s := <-states; s.InAlarm || !s.AlarmMemory {
+		t.Errorf("expected alarm memory after restore, got %+v", s)
+	}
+	if updated := p.Status().ZoneUpdated[4]; !updated.After(alarmed) {
+		t.Errorf("expected restore to update zone 5, last updated %v", updated)
+	}
+	f.send(Command{Code: CommandPartitionArmed, Data: "20"})
+	if s := <-states; s.AlarmMemory {
+		t.Errorf("expected alarm memory cleared by arming, got %+v", s)
+	}
+	f.send(Command{Code: CommandBypassedZones, Data: "1000000000000000"})
+	if s := <-states; !s.Bypassed {
+		t.Errorf("expected zone 5 bypassed, got %+v", s)
+	}
+	if updated := p.Status().ZoneUpdated[5]; updated.IsZero() {
+		t.Error("expected bypass dump to update zone 6")
+	}
+	if s := p.Status().Zones[4]; !s.Open || !s.Tampered || !s.Bypassed {
+		t.Errorf("unexpected zone 5 status %+v", s)
+	}
+	if len(legacy) != 1 {
+		t.Errorf("expected only the alarm as a legacy event, got %d", len(legacy))
+	}
+}
+
+func TestPanelPartitionState(t *testing.T) {
+	p, f := connectPanel(t)
+	defer p.Disconnect()
+
+	legacy := make(chan PartitionStatus, 16)
+	p.OnPartitionEvent(func(partition int, status PartitionStatus) {
+		legacy <- status
+	})
+	states := make(chan PartitionState, 8)
+	p.OnPartitionStateEvent(func(partition int, state PartitionState) {
+		if partition == 2 {
+			states <- state
+		}
+	})
+	// Only changes to the state are reported.
+	f.send(Command{Code: CommandPartitionReady, Data: "2"})
+	f.send(Command{Code: CommandPartitionNotReady, Data: "2"})
+	f.send(Command{Code: CommandPartitionNotReady, Data: "2"})
+	f.send(Command{Code: CommandPartitionExitDelay, Data: "2"})
+	<-states
+	<-states
+	if s := <-states; !s.ExitDelay || s.Ready {
+		t.Errorf("expected exit delay while not ready, got %+v", s)
+	}
+	f.send(Command{Code: CommandPartitionUserClosing, Data: "20003"})
+	f.send(Command{Code: CommandPartitionArmed, Data: "20"})
+	f.send(Command{Code: CommandPartitionAlarm, Data: "2"})
+	<-states
+	<-states
+	if s := <-states; s.ArmMode != ArmAway || s.ArmedBy != 3 || !s.InAlarm || s.ExitDelay {
+		t.Errorf("expected armed away by user 3 in alarm, got %+v", s)
+	}
+	f.send(Command{Code: CommandPartitionDisarmed, Data: "2"})
+	if s := <-states; s.ArmMode != 0 || s.InAlarm || s.ArmedBy != 0 {
+		t.Errorf("expected disarmed, got %+v", s)
+	}
+	// An entry delay ends when it expires into an alarm.
+	f.send(Command{Code: CommandPartitionArmed, Data: "20"})
+	f.send(Command{Code: CommandPartitionEntryDelay, Data: "2"})
+	f.send(Command{Code: CommandPartitionAlarm, Data: "2"})
+	<-states
+	<-states
+	if s := <-states; !s.InAlarm || s.EntryDelay || s.ExitDelay {
+		t.Errorf("expected alarm without entry delay, got %+v", s)
+	}
+	f.send(Command{Code: CommandPartitionDisarmed, Data: "2"})
+	<-states
+	disarmed := p.Status().PartitionUpdated[1]
+	f.send(Command{Code: CommandInstallerMode})
+	if s := <-states; !s.InstallerMode {
+		t.Errorf("expected installer's mode, got %+v", s)
+	}
+	if updated := p.Status().PartitionUpdated[1]; !updated.After(disarmed) {
+		t.Errorf("expected installer's mode to update partition 2, last updated %v", updated)
+	}
+	if s := p.Status().Partitions[0]; !s.InstallerMode {
+		t.Error("expected installer's mode on all partitions")
+	}
+	want := []PartitionStatus{PartitionStatusReady, PartitionStatusNotReady, PartitionStatusNotReady, PartitionStatusExitDelay,
+		PartitionStatusArmedAway, PartitionStatusAlarm, PartitionStatusDisarmed}
+	for _, w := range want {
+		if status := <-legacy; status != w {
+			t.Errorf("expected legacy %v, got %v", w, status)
+		}
+	}
+}
+
+func TestPanelReadyToArm(t *testing.T) {
+	p, f := connectPanel(t)
+	defer p.Disconnect()
+
+	if _, err := p.ReadyToArm(9); err != ErrInvalidPartition {
+		t.Errorf("expected ErrInvalidPartition, got %v", err)
+	}
+	f.send(Command{Code: CommandZoneOpen, Data: "003"})
+	f.send(Command{Code: CommandZoneOpen, Data: "004"})
+	f.send(Command{Code: CommandZoneTamper, Data: "2005"})
+	f.send(Command{Code: CommandZoneFault, Data: "006"})
+	f.send(Command{Code: CommandBypassedZones, Data: "0800000000000000"})
+	f.send(Command{Code: CommandPartitionNotReady, Data: "1"})
+	waitStatus(t, p, func(s *PanelStatus) bool {
+		return s.Zones[3].Bypassed && !s.PartitionUpdated[0].IsZero()
+	})
+
+	r, err := p.ReadyToArm(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Ready || !reflect.DeepEqual(r.Open, []int{3}) || !reflect.DeepEqual(r.Faulted, []int{6}) || r.Tampered != nil {
+		t.Errorf("unexpected report %+v", r)
+	}
+	if s := r.String(); s != "partition 1 not ready: open zones [3], faulted zones [6]" {
+		t.Errorf("unexpected report %q", s)
+	}
+	r, err = p.ReadyToArm(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blocking := r.Blocking(); !reflect.DeepEqual(blocking, []int{3, 5, 6}) {
+		t.Errorf("expected zones 3, 5 and 6 to block partition 2, got %v", blocking)
+	}
+}
+
+func TestPanelWaitFor(t *testing.T) {
+	p, f := connectPanel(t)
+	defer p.Disconnect()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := p.WaitFor(ctx, IsKeypadReady()); err != nil {
+		t.Fatal(err)
+	}
+
+	f.send(Command{Code: CommandZoneOpen, Data: "002"})
+	waitStatus(t, p, func(s *PanelStatus) bool { return s.Zones[1].Open })
+	done := make(chan error, 1)
+	go func() {
+		_, err := p.WaitFor(ctx, IsZoneClosed(2))
+		done <- err
+	}()
+	f.send(Command{Code: CommandZoneRestored, Data: "002"})
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// Errors reported by the panel do not end the wait.
+	go func() {
+		f.send(Command{Code: CommandCommandError, Data: "020"})
+		f.send(Command{Code: CommandPartitionArmed, Data: "21"})
+	}()
+	s, err := p.WaitFor(ctx, IsArmed(2, ArmStay))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Partitions[1].ArmMode != ArmStay {
+		t.Errorf("expected matching status, got %+v", s.Partitions[1])
+	}
+
+	short, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := p.WaitFor(short, IsDisarmed(2)); err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
@@ -0,0 +1,364 @@
+package etpi
+
+import "time"
+
+// PartitionEvent is a change to the state of a partition reported by the
+// panel.
+type PartitionEvent int
+
+const (
+	PartitionReady PartitionEvent = iota + 1
+	PartitionNotReady
+	PartitionReadyForceArm
+	PartitionArmed
+	PartitionInAlarm
+	PartitionDisarmed
+	PartitionExitDelay
+	PartitionEntryDelay
+	PartitionKeypadLockout
+	PartitionFailedToArm
+	PartitionBusy
+	PartitionInstallerMode
+	PartitionUserClosing
+	PartitionSpecialClosing
+	PartitionPartialClosing
+	PartitionUserOpening
+	PartitionSpecialOpening
+	// PartitionArmingInProgress is reported (674) while the partition is
+	// arming, before its exit delay. It does not change the PartitionState.
+	PartitionArmingInProgress
+)
+
+func (e PartitionEvent) String() string {
+	switch e {
+	case PartitionReady:
+		return "READY"
+	case PartitionNotReady:
+		return "NOT_READY"
+	case PartitionReadyForceArm:
+		return "READY_FORCE_ARM"
+	case PartitionArmed:
+		return "ARMED"
+	case PartitionInAlarm:
+		return "IN_ALARM"
+	case PartitionDisarmed:
+		return "DISARMED"
+	case PartitionExitDelay:
+		return "EXIT_DELAY"
+	case PartitionEntryDelay:
+		return "ENTRY_DELAY"
+	case PartitionKeypadLockout:
+		return "KEYPAD_LOCKOUT"
+	case PartitionFailedToArm:
+		return "FAILED_TO_ARM"
+	case PartitionBusy:
+		return "BUSY"
+	case PartitionInstallerMode:
+		return "INSTALLER_MODE"
+	case PartitionUserClosing:
+		return "USER_CLOSING"
+	case PartitionSpecialClosing:
+		return "SPECIAL_CLOSING"
+	case PartitionPartialClosing:
+		return "PARTIAL_CLOSING"
+	case PartitionUserOpening:
+		return "USER_OPENING"
+	case PartitionSpecialOpening:
+		return "SPECIAL_OPENING"
+	case PartitionArmingInProgress:
+		return "ARMING_IN_PROGRESS"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+var partitionEvents = map[string]PartitionEvent{
+	CommandPartitionReady:          PartitionReady,
+	CommandPartitionNotReady:       PartitionNotReady,
+	CommandPartitionReadyForceArm:  PartitionReadyForceArm,
+	CommandPartitionArmed:          PartitionArmed,
+	CommandPartitionAlarm:          PartitionInAlarm,
+	CommandPartitionDisarmed:       PartitionDisarmed,
+	CommandPartitionExitDelay:      PartitionExitDelay,
+	CommandPartitionEntryDelay:     PartitionEntryDelay,
+	CommandKeypadLockout:           PartitionKeypadLockout,
+	CommandPartitionFailedToArm:    PartitionFailedToArm,
+	CommandFailureToArm:            PartitionFailedToArm,
+	CommandPartitionBusy:           PartitionBusy,
+	CommandSystemArmingInProgress:  PartitionArmingInProgress,
+	CommandInstallerMode:           PartitionInstallerMode,
+	CommandPartitionUserClosing:    PartitionUserClosing,
+	CommandPartitionSpecialClosing: PartitionSpecialClosing,
+	CommandPartitionPartialClosing: PartitionPartialClosing,
+	CommandPartitionUserOpening:    PartitionUserOpening,
+	CommandPartitionSpecialOpening: PartitionSpecialOpening,
+}
+
+// armModes maps the mode digit of the 652 Partition Armed command to the
+// ArmMode it reports.
+var armModes = map[int]ArmMode{
+	0: ArmAway,
+	1: ArmStay,
+	2: ArmNoEntryDelay,
+	3: ArmInstant,
+}
+
+// status returns the PartitionStatus that e was reported as before
+// PartitionState, or UnknownStatus if it was not reported. detail is the mode
+// digit of PartitionArmed.
+func (e PartitionEvent) status(detail int) PartitionStatus {
+	switch e {
+	case PartitionReady:
+		return PartitionStatusReady
+	case PartitionNotReady:
+		return PartitionStatusNotReady
+	case PartitionArmed:
+		switch detail {
+		case 0:
+			return PartitionStatusArmedAway
+		case 1:
+			return PartitionStatusArmedStay
+		case 2:
+			return PartitionStatusArmedZeroEntryAway
+		case 3:
+			return PartitionStatusArmedZeroEntryStay
+		}
+	case PartitionInAlarm:
+		return PartitionStatusAlarm
+	case PartitionDisarmed:
+		return PartitionStatusDisarmed
+	case PartitionExitDelay:
+		return PartitionStatusExitDelay
+	case PartitionEntryDelay:
+		return PartitionStatusEntryDelay
+	case PartitionFailedToArm:
+		return PartitionStatusFailedToArm
+	case PartitionBusy:
+		return PartitionStatusBusy
+	}
+	return UnknownStatus
+}
+
+// PartitionState is the state of a partition, built up from every partition
+// event the panel reports.
+type PartitionState struct {
+	// ArmMode is how the partition is armed, or 0 if it is disarmed. It is
+	// kept while the partition is in alarm. As the panel reports night and
+	// force arming as stay and away, they are only known when requested
+	// with Arm.
+	ArmMode ArmMode
+	// Ready is whether the partition is ready to arm (650, 651, 653), and
+	// ForceArmReady whether it is only ready to force arm (653).
+	Ready         bool
+	ForceArmReady bool
+	// ExitDelay and EntryDelay are whether the partition is in its exit
+	// (656) or entry (657) delay, until it is armed, disarmed or in alarm.
+	ExitDelay  bool
+	EntryDelay bool
+	// InAlarm is whether the partition is in alarm (654).
+	InAlarm bool
+	// Busy is whether the partition is busy (673), e.g. because a keypad
+	// is in a menu, until its next ready, not ready, armed or disarmed
+	// event.
+	Busy bool
+	// KeypadLockout is whether the keypads are locked out after too many
+	// invalid codes (658), until the partition is next ready or not ready.
+	KeypadLockout bool
+	// InstallerMode is whether the panel is in installer's programming
+	// (680), until the partition is next ready or not ready.
+	InstallerMode bool
+	// Chime is whether the door chime is enabled (663, 664).
+	Chime bool
+	// ArmedBy is the user number that armed the partition (700), or 0 if
+	// it was armed without a user code or is disarmed.
+	ArmedBy int
+	// ChangedAt is when any of the above last changed.
+	ChangedAt time.Time
+}
+
+// apply updates s with event. detail is the mode digit of PartitionArmed and
+// the user number of PartitionUserClosing and PartitionUserOpening.
+func (s *PartitionState) apply(event PartitionEvent, detail int) {
+	switch event {
+	case PartitionReady, PartitionNotReady, PartitionReadyForceArm:
+		s.Ready = event != PartitionNotReady
+		s.ForceArmReady = event == PartitionReadyForceArm
+		s.Busy = false
+		s.KeypadLockout = false
+		s.InstallerMode = false
+	case PartitionArmed:
+		// Keep a requested night or force arming that the panel reports
+		// as stay or away.
+		if mode := armModes[detail]; s.ArmMode.reported() != mode {
+			s.ArmMode = mode
+		}
+		s.ExitDelay = false
+		s.EntryDelay = false
+		s.Busy = false
+	case PartitionInAlarm:
+		s.InAlarm = true
+		s.EntryDelay = false
+		s.ExitDelay = false
+	case PartitionDisarmed:
+		s.ArmMode = 0
+		s.ArmedBy = 0
+		s.InAlarm = false
+		s.ExitDelay = false
+		s.EntryDelay = false
+		s.Busy = false
+	case PartitionExitDelay:
+		s.ExitDelay = true
+	case PartitionEntryDelay:
+		s.EntryDelay = true
+	case PartitionKeypadLockout:
+		s.KeypadLockout = true
+	case PartitionFailedToArm:
+		s.ExitDelay = false
+	case PartitionBusy:
+		s.Busy = true
+	case PartitionInstallerMode:
+		s.InstallerMode = true
+	case PartitionUserClosing:
+		s.ArmedBy = detail
+	}
+}
+
+// handlePartitionEvent applies a partition event, reported for partition 0
+// if it applies to all partitions.
+func (p *panel) handlePartitionEvent(partition int, event PartitionEvent, detail int) {
+	if partition < 0 || partition > len(p.status.Partition) {
+		return
+	}
+	now := time.Now()
+	status := event.status(detail)
+	p.Lock()
+	s, staged := p.live()
+	var changed, zones, night []int
+	var mismatched []error
+	var report bool
+	for i := range s.Partitions {
+		if partition != 0 && i != partition-1 {
+			continue
+		}
+		state := s.Partitions[i]
+		state.apply(event, detail)
+		switch requested := p.arming[i].pending(now); event {
+		case PartitionArmed:
+			if requested == 0 {
+				break
+			}
+			p.arming[i] = armRequest{}
+			if requested.reported() != state.ArmMode.reported() {
+				mismatched = append(mismatched, &ArmModeError{Partition: i + 1, Requested: requested, Armed: state.ArmMode})
+				break
+			}
+			state.ArmMode = requested
+			if requested == ArmNight {
+				night = append(night, i+1)
+			}
+		case PartitionExitDelay:
+			if requested != 0 {
+				p.arming[i].expires = now.Add(maxExitDelay)
+			}
+		case PartitionDisarmed, PartitionFailedToArm, PartitionBusy:
+			p.arming[i] = armRequest{}
+		default:
+			// The exit delay ended without the partition being armed,
+			// e.g. by an alarm.
+			if s.Partitions[i].ExitDelay && !state.ExitDelay {
+				p.arming[i] = armRequest{}
+			}
+		}
+		if state != s.Partitions[i] {
+			state.ChangedAt = now
+			s.Partitions[i] = state
+			changed = append(changed, i+1)
+		}
+		if status != UnknownStatus {
+			// A status report repeats the status of every partition,
+			// so during a refresh only a change of status is reported.
+			report = report || !staged || s.Partition[i] != status
+			s.Partition[i] = status
+		}
+		s.PartitionUpdated[i] = now
+		if event == PartitionArmed {
+			zones = append(zones, p.clearAlarmMemory(s, i+1)...)
+		}
+	}
+	onPartition := p.onPartition
+	states, clearedZones := p.partitionStates(s, changed), p.zoneStates(s, zones)
+	p.deliver(staged, func() {
+		if report && onPartition != nil {
+			onPartition(partition, status)
+		}
+		states()
+		clearedZones()
+	})
+	p.armed(night, mismatched)
+}
+
+// maxExitDelay is the longest exit delay a panel can be programmed with.
+const maxExitDelay = 255 * time.Second
+
+// armRequest is an arm mode requested of a partition. It is pending until the
+// panel reports the partition armed or not armed, or until it expires: the
+// confirm timeout after the request, or the longest exit delay after the exit
+// delay starts.
+type armRequest struct {
+	mode    ArmMode
+	expires time.Time
+}
+
+// pending returns the requested mode, or 0 if there is no request pending at
+// now.
+func (r armRequest) pending(now time.Time) ArmMode {
+	if now.After(r.expires) {
+		return 0
+	}
+	return r.mode
+}
+
+// armed completes the arm requests confirmed by the panel, sending [*][1] to
+// the partitions armed stay for night, and reports those armed in a
+// different mode than requested.
+func (p *panel) armed(night []int, mismatched []error) {
+	for _, partition := range night {
+		// Keys are sent from the listener, which must not wait for their
+		// acknowledgement.
+		go func(partition int) {
+			if err := p.sendKeys(partition, "*1"); err != nil {
+				p.log.Warn("could not arm night zones", "partition", partition, "err", err)
+			}
+		}(partition)
+	}
+	// A mismatch is not an answer to the request in progress, if any, so it
+	// is only reported to the error callback.
+	p.RLock()
+	onError := p.onError
+	p.RUnlock()
+	for _, err := range mismatched {
+		p.log.Warn("partition armed in a different mode", "err", err)
+		if onError != nil {
+			onError(err)
+		}
+	}
+}
+
+// partitionStates returns a function that calls the partition state callback
+// with the current state in s of each of partitions. It must be called with p
+// locked.
+func (p *panel) partitionStates(s *PanelStatus, partitions []int) func() {
+	onPartState := p.onPartState
+	states := make([]PartitionState, len(partitions))
+	for i, partition := range partitions {
+		states[i] = s.Partitions[partition-1]
+	}
+	return func() {
+		if onPartState == nil {
+			return
+		}
+		for i, partition := range partitions {
+			onPartState(partition, states[i])
+		}
+	}
+}
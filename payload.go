@@ -0,0 +1,125 @@
+package etpi
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+)
+
+// field is one fixed width field of the data of a command received from the
+// Envisalink.
+type field struct {
+	name  string
+	width int
+	// min and max are the range of a decimal field. If max is 0 the value
+	// is not range checked.
+	min, max int
+	// hex is set for a field of hex digits rather than decimal digits.
+	hex bool
+}
+
+var (
+	partitionField  = field{name: "partition", width: 1, min: 1, max: maxPartitions}
+	zoneField       = field{name: "zone", width: 3, min: 1, max: maxZones}
+	thermostatField = field{name: "thermostat", width: 1, min: 1, max: 4}
+	degreesField    = field{name: "temperature", width: 3, min: 0, max: 255}
+	outputField     = field{name: "output", width: 1, min: 1, max: 4}
+	ledField        = field{name: "leds", width: 2, hex: true}
+	userField       = field{name: "user", width: 4}
+)
+
+// payloads describes the data expected for each command received from the
+// Envisalink. Commands that are not listed are not checked; responses to a
+// command sent are passed on as is, so that a malformed one fails the send
+// rather than leaving it to time out.
+var payloads = map[string][]field{
+	CommandLoginStatus:               {{name: "status", width: 1, min: 0, max: 3}},
+	CommandKeypadLed:                 {ledField},
+	CommandKeypadLedFlash:            {ledField},
+	CommandTimeBroadcast:             {{name: "time", width: 10}},
+	CommandRingDetected:              {},
+	CommandIndoorTemperature:         {thermostatField, degreesField},
+	CommandOutdoorTemperature:        {thermostatField, degreesField},
+	CommandThermostatSetPoints:       {thermostatField, degreesField, degreesField},
+	CommandZoneAlarm:                 {partitionField, zoneField},
+	CommandZoneAlarmRestore:          {partitionField, zoneField},
+	CommandZoneTamper:                {partitionField, zoneField},
+	CommandZoneTamperRestore:         {partitionField, zoneField},
+	CommandZoneFault:                 {zoneField},
+	CommandZoneFaultRestore:          {zoneField},
+	CommandZoneOpen:                  {zoneField},
+	CommandZoneRestored:              {zoneField},
+	CommandBypassedZones:             {{name: "bypassed zones", width: 16, hex: true}},
+	CommandDuressAlarm:               {{name: "duress", width: 4}},
+	CommandSmokeAuxAlarm:             {},
+	CommandSmokeAuxAlarmRestore:      {},
+	CommandPartitionReady:            {partitionField},
+	CommandPartitionNotReady:         {partitionField},
+	CommandPartitionArmed:            {partitionField, {name: "mode", width: 1, min: 0, max: 3}},
+	CommandPartitionReadyForceArm:    {partitionField},
+	CommandPartitionDisarmed:         {partitionField},
+	CommandPartitionAlarm:            {partitionField},
+	CommandPartitionExitDelay:        {partitionField},
+	CommandPartitionEntryDelay:       {partitionField},
+	CommandKeypadLockout:             {partitionField},
+	CommandPartitionFailedToArm:      {partitionField},
+	CommandPartitionOutputInProgress: {partitionField},
+	CommandPartitionChimeEnabled:     {partitionField},
+	CommandPartitionChimeDisabled:    {partitionField},
+	CommandInvalidAccessCode:         {partitionField},
+	CommandFunctionNotAvailable:      {partitionField},
+	CommandFailureToArm:              {partitionField},
+	CommandPartitionBusy:             {partitionField},
+	CommandSystemArmingInProgress:    {partitionField},
+	CommandInstallerMode:             {},
+	CommandPartitionUserClosing:      {partitionField, userField},
+	CommandPartitionSpecialClosing:   {partitionField},
+	CommandPartitionPartialClosing:   {partitionField},
+	CommandPartitionUserOpening:      {partitionField, userField},
+	CommandPartitionSpecialOpening:   {partitionField},
+	CommandFTCTrouble:                {},
+	CommandBufferNearFull:            {},
+	CommandTroubleOn:                 {partitionField},
+	CommandTroubleOff:                {partitionField},
+	CommandFireTroubleAlarm:          {},
+	CommandFireTroubleAlarmRestore:   {},
+	CommandOutputPressed:             {partitionField, outputField},
+}
+
+// validate checks that the data of cmd has the length, digits and ranges
+// expected for its command code, so that it can be decoded without further
+// checks.
+func validate(cmd Command) error {
+	fields, ok := payloads[cmd.Code]
+	if !ok {
+		return nil
+	}
+	n := 0
+	for _, f := range fields {
+		n += f.width
+	}
+	if len(cmd.Data) != n {
+		return fmt.Errorf("expected %d characters of data, got %d", n, len(cmd.Data))
+	}
+	data := cmd.Data
+	for _, f := range fields {
+		s := data[:f.width]
+		data = data[f.width:]
+		if f.hex {
+			if _, err := hex.DecodeString(s); err != nil {
+				return fmt.Errorf("invalid %s %q", f.name, s)
+			}
+			continue
+		}
+		for i := 0; i < len(s); i++ {
+			if s[i] < '0' || s[i] > '9' {
+				return fmt.Errorf("invalid %s %q", f.name, s)
+			}
+		}
+		v, _ := strconv.Atoi(s)
+		if f.max > 0 && (v < f.min || v > f.max) {
+			return fmt.Errorf("%s %d out of range", f.name, v)
+		}
+	}
+	return nil
+}
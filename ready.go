@@ -0,0 +1,96 @@
+package etpi
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ReadyReport tells whether a partition is ready to arm and, if not, which
+// zones are keeping it from arming.
+type ReadyReport struct {
+	Partition int
+	// Ready is whether the panel reports the partition ready to arm (650,
+	// 653), and ForceArmReady whether it is only ready to force arm (653).
+	Ready         bool
+	ForceArmReady bool
+	// Open, Faulted and Tampered are the zones of the partition that are
+	// open, faulted or tampered and not bypassed. Zones whose partition has
+	// not been learned yet are included, as they may belong to it.
+	Open     []int
+	Faulted  []int
+	Tampered []int
+}
+
+// Blocking returns the zones listed in r, in order and without duplicates.
+func (r *ReadyReport) Blocking() []int {
+	seen := make(map[int]bool)
+	var zones []int
+	for _, list := range [][]int{r.Open, r.Faulted, r.Tampered} {
+		for _, zone := range list {
+			if !seen[zone] {
+				seen[zone] = true
+				zones = append(zones, zone)
+			}
+		}
+	}
+	sort.Ints(zones)
+	return zones
+}
+
+func (r *ReadyReport) String() string {
+	if r.Ready && !r.ForceArmReady {
+		return fmt.Sprintf("partition %d ready to arm", r.Partition)
+	}
+	state := "not ready"
+	if r.ForceArmReady {
+		state = "ready to force arm"
+	}
+	var zones []string
+	if len(r.Open) > 0 {
+		zones = append(zones, fmt.Sprintf("open zones %v", r.Open))
+	}
+	if len(r.Faulted) > 0 {
+		zones = append(zones, fmt.Sprintf("faulted zones %v", r.Faulted))
+	}
+	if len(r.Tampered) > 0 {
+		zones = append(zones, fmt.Sprintf("tampered zones %v", r.Tampered))
+	}
+	if len(zones) == 0 {
+		return fmt.Sprintf("partition %d %s", r.Partition, state)
+	}
+	return fmt.Sprintf("partition %d %s: %s", r.Partition, state, strings.Join(zones, ", "))
+}
+
+// ReadyToArm reports whether a partition is ready to arm, from its state
+// and the state of its zones. The zones of a partition are learned from the
+// partition reported with their alarm and tamper events (601, 603), and
+// bypassed zones from the bypassed zones dump (616).
+func (p *panel) ReadyToArm(partition int) (*ReadyReport, error) {
+	if partition < 1 || partition > len(p.status.Partition) {
+		return nil, ErrInvalidPartition
+	}
+	p.RLock()
+	defer p.RUnlock()
+	state := p.status.Partitions[partition-1]
+	r := &ReadyReport{
+		Partition:     partition,
+		Ready:         state.Ready,
+		ForceArmReady: state.ForceArmReady,
+	}
+	for i, zone := range p.status.Zones {
+		if zone.Bypassed || (zone.Partition != 0 && zone.Partition != partition) {
+			continue
+		}
+		if zone.Open {
+			r.Open = append(r.Open, i+1)
+		}
+		if zone.Faulted {
+			r.Faulted = append(r.Faulted, i+1)
+		}
+		if zone.Tampered {
+			r.Tampered = append(r.Tampered, i+1)
+		}
+	}
+	return r, nil
+}
@@ -0,0 +1,151 @@
+package etpi
+
+import (
+	"context"
+	"time"
+)
+
+// Refresh requests a status report (001) from the panel. The panel replies
+// with a burst of zone, partition and keypad states that has no end marker,
+// so the report is considered complete once no frame has been received for
+// the settle time (see WithSettleTime). Until then the states are collected
+// aside, and they are then published to Status at once. The events for the
+// states received meanwhile, whether part of the report or not, are then
+// emitted in the order they were received, correcting for changes that were
+// missed.
+func (p *panel) Refresh(ctx context.Context) error {
+	p.refreshing.Lock()
+	defer p.refreshing.Unlock()
+	p.beginRefresh()
+	err := p.conn.Status()
+	if err == nil {
+		err = p.settle(ctx)
+	}
+	// Publish what was received even if the report was cut short, as it is
+	// still newer than the current status.
+	p.endRefresh(true)
+	return err
+}
+
+// live returns the status that zone, partition and keypad updates apply to,
+// and whether it is staged by a refresh in progress. It must be called with p
+// locked.
+func (p *panel) live() (*PanelStatus, bool) {
+	if p.staged != nil {
+		return p.staged, true
+	}
+	return p.status, false
+}
+
+// deliver completes an update to the status, queueing emit to report it once
+// p is ready. The queue is drained in order, and not during a refresh, so the
+// events received meanwhile are emitted once it ends. It must be called with
+// p locked, and unlocks it.
+func (p *panel) deliver(staged bool, emit func()) {
+	if !staged {
+		p.changed()
+	}
+	if staged || p.ready {
+		p.replay = append(p.replay, emit)
+	}
+	p.Unlock()
+	if !staged {
+		p.drain()
+	}
+}
+
+// drain emits the queued events in order. Only one goroutine emits at a time:
+// events queued while another is emitting, or during a refresh, are left to
+// it or to the end of the refresh.
+func (p *panel) drain() {
+	p.Lock()
+	if p.staged != nil || p.emitting {
+		p.Unlock()
+		return
+	}
+	p.emitting = true
+	for len(p.replay) > 0 && p.staged == nil {
+		queued := p.replay
+		p.replay = nil
+		p.Unlock()
+		for _, emit := range queued {
+			emit()
+		}
+		p.Lock()
+	}
+	p.emitting = false
+	p.Unlock()
+}
+
+func (p *panel) beginRefresh() {
+	p.Lock()
+	p.staged = p.status.clone()
+	p.Unlock()
+}
+
+// settle waits until no frame has been received for the settle time.
+func (p *panel) settle(ctx context.Context) error {
+	for {
+		quiet := time.Since(p.conn.Health().LastReceived)
+		if quiet >= p.settleTime {
+			return nil
+		}
+		t := time.NewTimer(p.settleTime - quiet)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// endRefresh ends the refresh in progress, publishing the staged zone,
+// partition and keypad states if publish is set and emitting the events
+// queued meanwhile.
+func (p *panel) endRefresh(publish bool) {
+	p.Lock()
+	staged := p.staged
+	p.staged = nil
+	if !publish {
+		p.replay = nil
+		p.Unlock()
+		return
+	}
+	copy(p.status.Zone, staged.Zone)
+	copy(p.status.Zones, staged.Zones)
+	copy(p.status.ZoneUpdated, staged.ZoneUpdated)
+	copy(p.status.Partition, staged.Partition)
+	copy(p.status.Partitions, staged.Partitions)
+	copy(p.status.PartitionUpdated, staged.PartitionUpdated)
+	p.status.Keypad = staged.Keypad
+	p.status.KeypadUpdated = staged.KeypadUpdated
+	p.changed()
+	if !p.ready {
+		p.replay = nil
+		p.Unlock()
+		return
+	}
+	p.log.Debug("status refreshed", "events", len(p.replay))
+	p.Unlock()
+	p.drain()
+}
+
+// reconcileStatus refreshes the panel status every reconcile interval until
+// stop is closed.
+func (p *panel) reconcileStatus(stop chan struct{}) {
+	t := time.NewTicker(p.reconcile)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), p.confirm)
+		if err := p.Refresh(ctx); err != nil {
+			p.log.Warn("could not refresh status", "err", err)
+		}
+		cancel()
+	}
+}
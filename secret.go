@@ -0,0 +1,71 @@
+package etpi
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Secret supplies a code when the panel asks for it, e.g. from a file or a
+// secrets manager, so that it need not be held by the caller.
+type Secret func() (string, error)
+
+// StaticSecret returns a Secret that always supplies code.
+func StaticSecret(code string) Secret {
+	return func() (string, error) {
+		return code, nil
+	}
+}
+
+// FileSecret returns a Secret that reads the code from a file each time it
+// is needed, ignoring surrounding whitespace.
+func FileSecret(path string) Secret {
+	return func() (string, error) {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+}
+
+// CodeKind identifies which code the panel is asking for.
+type CodeKind int
+
+const (
+	UserCode CodeKind = iota + 1
+	MasterCode
+	InstallerCode
+)
+
+func (k CodeKind) String() string {
+	switch k {
+	case UserCode:
+		return "user"
+	case MasterCode:
+		return "master"
+	case InstallerCode:
+		return "installer"
+	default:
+		return "unknown"
+	}
+}
+
+var ErrCodeNotConfigured = errors.New("code not configured")
+
+// CodeRequiredError is reported when the panel asks for a code (900, 921 or
+// 922) that could not be supplied, either because it is not configured
+// (ErrCodeNotConfigured) or because its Secret failed.
+type CodeRequiredError struct {
+	Kind CodeKind
+	Err  error
+}
+
+func (e *CodeRequiredError) Error() string {
+	return fmt.Sprintf("%s code required: %v", e.Kind, e.Err)
+}
+
+func (e *CodeRequiredError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,125 @@
+package etpi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrInvalidSlot = errors.New("invalid user code slot, must be 1-95")
+var ErrInvalidCode = errors.New("invalid access code, must be 4 or 6 digits")
+
+// masterCodeSlot is the user code slot holding the master code, which can be
+// changed but not deleted.
+const masterCodeSlot = 40
+
+// maxKeys is the most keys that can be sent in one 071 keystroke command.
+const maxKeys = 6
+
+func (p *panel) SetUserCode(slot int, code string) error {
+	if slot < 1 || slot > 95 {
+		return ErrInvalidSlot
+	}
+	if !validCode(code) {
+		return ErrInvalidCode
+	}
+	return p.programUserCode(fmt.Sprintf("%02d%s", slot, code))
+}
+
+func (p *panel) DeleteUserCode(slot int) error {
+	if slot < 1 || slot > 95 || slot == masterCodeSlot {
+		return ErrInvalidSlot
+	}
+	// A code is deleted by entering [*] as its first digit.
+	return p.programUserCode(fmt.Sprintf("%02d*", slot))
+}
+
+// programUserCode enters user code programming ([*][5]) on partition 1 with
+// the 072 command, waits for the master code requested by the panel (921) to
+// be sent, then enters keys and exits with [#]. It returns once the partition
+// reports its status after leaving programming. If it fails once programming
+// is entered, it still tries to exit so the keypad is not left in it.
+func (p *panel) programUserCode(keys string) error {
+	const partition = 1
+	start := time.Now()
+	if err := p.conn.Send(Command{Code: CommandUserCodeProgramming, Data: fmt.Sprint(partition)}); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.confirm)
+	defer cancel()
+	if _, err := p.await(ctx, start, func(*PanelStatus) bool {
+		return p.codeSent[MasterCode].After(start)
+	}); err != nil {
+		p.exitProgramming(partition)
+		if err == context.DeadlineExceeded {
+			return ErrNotConfirmed
+		}
+		return err
+	}
+
+	if err := p.sendKeys(partition, keys); err != nil {
+		p.exitProgramming(partition)
+		return err
+	}
+	exited := time.Now()
+	if err := p.sendKeys(partition, "#"); err != nil {
+		return err
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), p.confirm)
+	defer cancel()
+	if _, err := p.await(ctx, start, func(s *PanelStatus) bool {
+		return s.PartitionUpdated[partition-1].After(exited)
+	}); err != nil {
+		if err == context.DeadlineExceeded {
+			return ErrNotConfirmed
+		}
+		return err
+	}
+	return nil
+}
+
+// exitProgramming leaves programming on a partition with [#] after a
+// failure, logging rather than returning an error as there is nothing more
+// to do about it.
+func (p *panel) exitProgramming(partition int) {
+	if err := p.sendKeys(partition, "#"); err != nil {
+		p.log.Warn("could not exit programming", "partition", partition, "err", err)
+	}
+}
+
+// sendKeys sends keys to a partition with as many 071 keystroke commands as
+// needed.
+func (p *panel) sendKeys(partition int, keys string) error {
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > maxKeys {
+			n = maxKeys
+		}
+		data := fmt.Sprintf("%d%s", partition, keys[:n])
+		if err := p.conn.Send(Command{Code: CommandKeystroke, Data: data}); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+func (p *panel) handleCodeSent(kind CodeKind) {
+	p.Lock()
+	p.codeSent[kind] = time.Now()
+	p.wake()
+	p.Unlock()
+}
+
+func validCode(code string) bool {
+	if len(code) != 4 && len(code) != 6 {
+		return false
+	}
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
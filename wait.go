@@ -0,0 +1,47 @@
+package etpi
+
+import (
+	"context"
+	"time"
+)
+
+// Condition is a condition of the panel status that WaitFor waits for. It
+// must not call methods of the Panel.
+type Condition func(*PanelStatus) bool
+
+// WaitFor blocks until cond is true of the panel status, evaluating it again
+// each time the status changes, and returns a snapshot of the matching
+// status. It returns the context's error if ctx is done first.
+func (p *panel) WaitFor(ctx context.Context, cond Condition) (*PanelStatus, error) {
+	return p.await(ctx, time.Time{}, cond)
+}
+
+// IsArmed is true once a partition is armed in mode.
+func IsArmed(partition int, mode ArmMode) Condition {
+	return func(s *PanelStatus) bool {
+		return partition >= 1 && partition <= len(s.Partitions) &&
+			s.Partitions[partition-1].ArmMode == mode
+	}
+}
+
+// IsDisarmed is true once a partition is disarmed.
+func IsDisarmed(partition int) Condition {
+	return func(s *PanelStatus) bool {
+		return partition >= 1 && partition <= len(s.Partitions) &&
+			s.Partitions[partition-1].ArmMode == 0
+	}
+}
+
+// IsZoneClosed is true once a zone is closed.
+func IsZoneClosed(zone int) Condition {
+	return func(s *PanelStatus) bool {
+		return zone >= 1 && zone <= len(s.Zones) && !s.Zones[zone-1].Open
+	}
+}
+
+// IsKeypadReady is true once the Ready LED of the keypad is on.
+func IsKeypadReady() Condition {
+	return func(s *PanelStatus) bool {
+		return s.Keypad.Ready
+	}
+}
@@ -0,0 +1,213 @@
+package etpi
+
+import "time"
+
+// ZoneEvent is a change to the state of a zone reported by the panel.
+type ZoneEvent int
+
+const (
+	ZoneAlarm ZoneEvent = iota + 1
+	ZoneAlarmRestored
+	ZoneTamper
+	ZoneTamperRestored
+	ZoneFault
+	ZoneFaultRestored
+	ZoneOpened
+	ZoneClosed
+)
+
+func (e ZoneEvent) String() string {
+	switch e {
+	case ZoneAlarm:
+		return "ALARM"
+	case ZoneAlarmRestored:
+		return "ALARM_RESTORED"
+	case ZoneTamper:
+		return "TAMPER"
+	case ZoneTamperRestored:
+		return "TAMPER_RESTORED"
+	case ZoneFault:
+		return "FAULT"
+	case ZoneFaultRestored:
+		return "FAULT_RESTORED"
+	case ZoneOpened:
+		return "OPENED"
+	case ZoneClosed:
+		return "CLOSED"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+var zoneEvents = map[string]ZoneEvent{
+	CommandZoneAlarm:         ZoneAlarm,
+	CommandZoneAlarmRestore:  ZoneAlarmRestored,
+	CommandZoneTamper:        ZoneTamper,
+	CommandZoneTamperRestore: ZoneTamperRestored,
+	CommandZoneFault:         ZoneFault,
+	CommandZoneFaultRestore:  ZoneFaultRestored,
+	CommandZoneOpen:          ZoneOpened,
+	CommandZoneRestored:      ZoneClosed,
+}
+
+// status returns the ZoneStatus that e was reported as before ZoneState, or
+// UnknownStatus if it was not reported.
+func (e ZoneEvent) status() ZoneStatus {
+	switch e {
+	case ZoneAlarm:
+		return ZoneStatusAlarm
+	case ZoneTamper:
+		return ZoneStatusTamper
+	case ZoneFault:
+		return ZoneStatusFault
+	case ZoneOpened:
+		return ZoneStatusOpen
+	case ZoneClosed:
+		return ZoneStatusRestored
+	default:
+		return UnknownStatus
+	}
+}
+
+// ZoneState is the state of a zone, built up from every zone event the
+// panel reports.
+type ZoneState struct {
+	// Open is whether the zone is open (609) or closed (610).
+	Open bool
+	// Faulted is whether the zone has a fault (605, 606).
+	Faulted bool
+	// Tampered is whether the zone is tampered (603, 604).
+	Tampered bool
+	// InAlarm is whether the zone is in alarm (601, 602), and AlarmMemory
+	// whether it has been in alarm since its partition was last armed.
+	InAlarm     bool
+	AlarmMemory bool
+	// Bypassed is whether the zone is bypassed, from the bypassed zones
+	// dump (616).
+	Bypassed bool
+	// LastChanged is when any of the above last changed.
+	LastChanged time.Time
+	// Partition is the partition of the zone, once learned from an alarm or
+	// tamper event, otherwise 0.
+	Partition int
+}
+
+// apply updates s with event, reported for partition (0 if not reported).
+func (s *ZoneState) apply(partition int, event ZoneEvent) {
+	if partition != 0 {
+		s.Partition = partition
+	}
+	switch event {
+	case ZoneAlarm:
+		s.InAlarm = true
+		s.AlarmMemory = true
+	case ZoneAlarmRestored:
+		s.InAlarm = false
+	case ZoneTamper, ZoneTamperRestored:
+		s.Tampered = event == ZoneTamper
+	case ZoneFault, ZoneFaultRestored:
+		s.Faulted = event == ZoneFault
+	case ZoneOpened, ZoneClosed:
+		s.Open = event == ZoneOpened
+	}
+}
+
+func (p *panel) handleZoneEvent(zone int, partition int, event ZoneEvent) {
+	if zone < 1 || zone > len(p.status.Zone) {
+		return
+	}
+	now := time.Now()
+	status := event.status()
+	p.Lock()
+	s, staged := p.live()
+	state := s.Zones[zone-1]
+	state.apply(partition, event)
+	changed := state != s.Zones[zone-1]
+	if changed {
+		state.LastChanged = now
+		s.Zones[zone-1] = state
+	}
+	// A status report repeats the status of every zone, so during a refresh
+	// only a change of status is reported.
+	report := status != UnknownStatus && (!staged || s.Zone[zone-1] != status)
+	if status != UnknownStatus {
+		s.Zone[zone-1] = status
+	}
+	s.ZoneUpdated[zone-1] = now
+	onZone, onZoneState := p.onZone, p.onZoneState
+	p.deliver(staged, func() {
+		if report && onZone != nil {
+			onZone(zone, status)
+		}
+		if changed && onZoneState != nil {
+			onZoneState(zone, state)
+		}
+	})
+}
+
+// handleBypassedZones marks the listed zones bypassed and all others not.
+func (p *panel) handleBypassedZones(zones []int) {
+	bypassed := make(map[int]bool, len(zones))
+	for _, zone := range zones {
+		bypassed[zone] = true
+	}
+	p.Lock()
+	s, staged := p.live()
+	changed := p.setZones(s, func(zone int, state *ZoneState) {
+		state.Bypassed = bypassed[zone]
+	})
+	// The dump reports every zone, whether it changed or not.
+	now := time.Now()
+	for i := range s.ZoneUpdated {
+		s.ZoneUpdated[i] = now
+	}
+	p.deliver(staged, p.zoneStates(s, changed))
+}
+
+// clearAlarmMemory clears the alarm memory of the zones of a partition, as
+// the panel does when the partition is armed. It must be called with p
+// locked, and returns the zones that changed.
+func (p *panel) clearAlarmMemory(s *PanelStatus, partition int) []int {
+	return p.setZones(s, func(zone int, state *ZoneState) {
+		if state.Partition == partition {
+			state.AlarmMemory = false
+		}
+	})
+}
+
+// setZones calls f to update the state of every zone in s, and returns the
+// zones that changed, which are marked updated. It must be called with p
+// locked.
+func (p *panel) setZones(s *PanelStatus, f func(zone int, state *ZoneState)) []int {
+	now := time.Now()
+	var changed []int
+	for i := range s.Zones {
+		state := s.Zones[i]
+		f(i+1, &state)
+		if state != s.Zones[i] {
+			state.LastChanged = now
+			s.Zones[i] = state
+			s.ZoneUpdated[i] = now
+			changed = append(changed, i+1)
+		}
+	}
+	return changed
+}
+
+// zoneStates returns a function that calls the zone state callback with the
+// current state in s of each of zones. It must be called with p locked.
+func (p *panel) zoneStates(s *PanelStatus, zones []int) func() {
+	onZoneState := p.onZoneState
+	states := make([]ZoneState, len(zones))
+	for i, zone := range zones {
+		states[i] = s.Zones[zone-1]
+	}
+	return func() {
+		if onZoneState == nil {
+			return
+		}
+		for i, zone := range zones {
+			onZoneState(zone, states[i])
+		}
+	}
+}